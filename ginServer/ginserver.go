@@ -1,23 +1,51 @@
 package ginServer
 
 import (
+	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sync"
 	"syscall"
 
 	"github.com/ljhhhhhh1224/mini_cmux/logging"
+	mini_cmux2 "github.com/ljhhhhhh1224/mini_cmux/mini_cmux"
 	"github.com/ljhhhhhh1224/mini_cmux/syscallOperate"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/websocket"
 )
 
+var (
+	metricsMux mini_cmux2.CMux
+	metricsMu  sync.RWMutex
+)
+
+// RegisterMetrics 设置 /metrics 路由暴露统计数据的多路复用器
+func RegisterMetrics(m mini_cmux2.CMux) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsMux = m
+}
+
 // SetupRouter 创建路由
 func SetupRouter() *gin.Engine {
 	router := gin.Default()
 	router.GET("get", get)
 	router.GET("stop", stop)
+	router.GET("logs", logs)
+	router.GET("metrics", metrics)
 	return router
 }
 
+// H2CHandler 使 router 可以在明文连接上同时处理 HTTP 1 请求、h2c 升级请求
+// 以及直接发送 HTTP2 preface 的请求
+func H2CHandler(router *gin.Engine) http.Handler {
+	return h2c.NewHandler(router, &http2.Server{})
+}
+
 // get
 func get(c *gin.Context) {
 	logging.Info("Receive Http /get request from ", c.ClientIP())
@@ -34,3 +62,61 @@ func stop(c *gin.Context) {
 	})
 	syscallOperate.GetSyscallChan() <- syscall.SIGINT
 }
+
+var errCrossOrigin = errors.New("cross-origin websocket request")
+
+// sameOrigin 只接受 Origin 与请求 Host 一致的 WebSocket 握手,
+// 防止其他网页跨站订阅日志
+func sameOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil || origin.Host != req.Host {
+		return errCrossOrigin
+	}
+	config.Origin = origin
+	return nil
+}
+
+// logs 通过 WebSocket 向客户端推送实时日志
+func logs(c *gin.Context) {
+	websocket.Server{Handshake: sameOrigin, Handler: func(ws *websocket.Conn) {
+		lines, cancel := logging.Subscribe()
+		defer cancel()
+		logging.Info("Receive WebSocket /logs request from ", c.ClientIP())
+
+		// 客户端关闭连接后读取会返回错误
+		done := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, ws)
+			close(done)
+		}()
+		for {
+			select {
+			case line := <-lines:
+				if err := websocket.Message.Send(ws, line); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}}.ServeHTTP(c.Writer, c.Request)
+}
+
+// metrics 以 Prometheus 文本格式返回多路复用器的统计数据
+func metrics(c *gin.Context) {
+	metricsMu.RLock()
+	m := metricsMux
+	metricsMu.RUnlock()
+	if m == nil {
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+	c.Header("Content-Type", mini_cmux2.PrometheusContentType)
+	c.Status(http.StatusOK)
+	if err := m.Stats().WritePrometheus(c.Writer); err != nil {
+		logging.Error("Write metrics : ", err)
+	}
+}
@@ -1,10 +1,19 @@
 package ginServer
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	mini_cmux2 "github.com/ljhhhhhh1224/mini_cmux/mini_cmux"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/websocket"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -40,6 +49,72 @@ func TestStop(t *testing.T) {
 	})
 }
 
+func TestH2C(t *testing.T) {
+	s := httptest.NewServer(H2CHandler(SetupRouter()))
+	defer s.Close()
+	Convey("Test gin handler /get over h2c", t, func() {
+		client := http.Client{
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			},
+		}
+		resp, err := client.Get(s.URL + "/get")
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+		So(resp.ProtoMajor, ShouldEqual, 2)
+		var body map[string]string
+		So(json.NewDecoder(resp.Body).Decode(&body), ShouldBeNil)
+		So(body["message"], ShouldEqual, "get message successfully")
+	})
+}
+
+func TestLogs(t *testing.T) {
+	s := httptest.NewServer(SetupRouter())
+	defer s.Close()
+	Convey("Test gin websocket handler /logs", t, func() {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/logs", "", s.URL)
+		So(err, ShouldBeNil)
+		defer ws.Close()
+		// 处理函数订阅后记录的第一条日志即为本次请求的日志
+		_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var line string
+		So(websocket.Message.Receive(ws, &line), ShouldBeNil)
+		So(line, ShouldContainSubstring, "Receive WebSocket /logs request")
+	})
+
+	Convey("Test gin websocket handler /logs rejects cross-origin requests", t, func() {
+		_, err := websocket.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/logs", "", "http://evil.example.com")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	r := SetupRouter()
+	Convey("Test gin handler /metrics", t, func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		m := mini_cmux2.New(l)
+		m.MatchNamed("http", mini_cmux2.HTTP1Fast())
+		RegisterMetrics(m)
+		defer RegisterMetrics(nil)
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Header().Get("Content-Type"), ShouldEqual, mini_cmux2.PrometheusContentType)
+		So(w.Body.String(), ShouldContainSubstring, "mini_cmux_connections_matched_total{listener=\"http\"} 0\n")
+		So(w.Body.String(), ShouldContainSubstring, "# TYPE mini_cmux_sniff_duration_seconds histogram\n")
+	})
+}
+
 //func TestGet(t *testing.T) {
 //	r := gofight.New()
 //	r.GET("/get").Run(SetupRouter(), func(response gofight.HTTPResponse, request gofight.HTTPRequest) {
@@ -2,6 +2,7 @@ package logging
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -33,7 +34,7 @@ func init() {
 	filePath := getLogFileFullPath()
 	F = openLogFile(filePath)
 
-	logger = log.New(F, DefaultPrefix, log.LstdFlags)
+	logger = log.New(io.MultiWriter(F, tail), DefaultPrefix, log.LstdFlags)
 }
 
 func Debug(v ...interface{}) {
@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"strings"
+	"sync"
+)
+
+// 每个订阅者缓存的日志条数, 订阅者处理不及时时丢弃新日志而不阻塞写日志的一方
+const tailBufLen = 64
+
+var tail = &tailWriter{subs: make(map[chan string]struct{})}
+
+// tailWriter 将写入的每条日志广播给所有订阅者
+type tailWriter struct {
+	mu   sync.Mutex
+	subs map[chan string]struct{}
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ch := range t.subs {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// Subscribe 订阅之后写入的日志, 返回日志channel与取消订阅的方法
+func Subscribe() (<-chan string, func()) {
+	ch := make(chan string, tailBufLen)
+	tail.mu.Lock()
+	tail.subs[ch] = struct{}{}
+	tail.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			tail.mu.Lock()
+			delete(tail.subs, ch)
+			tail.mu.Unlock()
+		})
+	}
+}
@@ -2,9 +2,16 @@ package mini_cmux
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
 )
 
+var SniffLimitErr = errors.New("sniff limit exceeded")
+
 // bufferedReader 实现了 io.Reader 接口,
 type bufferedReader struct {
 	source     io.Reader
@@ -13,10 +20,26 @@ type bufferedReader struct {
 	bufferSize int  //总字节数
 	sniffing   bool //状态
 	lastErr    error
+	sniffErr   error // 嗅探阶段读取 source 时遇到的第一个错误
+
+	maxBytes     int // 嗅探阶段最多缓存的总字节数, 0 表示不限制
+	matcherBytes int // 每个匹配器最多读取的字节数, 0 表示不限制
+	matcherRead  int // 当前匹配器已读取的字节数
 }
 
 func (s *bufferedReader) Read(p []byte) (int, error) {
 
+	// 限制当前匹配器可读取的字节数
+	if s.sniffing && s.matcherBytes > 0 {
+		remain := s.matcherBytes - s.matcherRead
+		if remain <= 0 {
+			return 0, SniffLimitErr
+		}
+		if len(p) > remain {
+			p = p[:remain]
+		}
+	}
+
 	if s.bufferSize > s.bufferRead {
 		// If we have already read something from the buffer before, we return the
 		// same data and the last error if any. We need to immediately return,
@@ -25,6 +48,7 @@ func (s *bufferedReader) Read(p []byte) (int, error) {
 		// 在此之前在buffer读取过数据的话,继续从buffer中读取
 		bn := copy(p, s.buffer.Bytes()[s.bufferRead:s.bufferSize])
 		s.bufferRead += bn
+		s.matcherRead += bn
 		return bn, s.lastErr
 	} else if !s.sniffing && s.buffer.Cap() != 0 {
 		// 如果嗅探结束就重置buffer
@@ -33,8 +57,24 @@ func (s *bufferedReader) Read(p []byte) (int, error) {
 
 	//如果在buffer中没有读取到数据，则从source中读取
 
+	// 限制嗅探阶段缓存的总字节数, 超出后视为未匹配
+	if s.sniffing && s.maxBytes > 0 {
+		remain := s.maxBytes - s.buffer.Len()
+		if remain <= 0 {
+			s.sniffErr = SniffLimitErr
+			return 0, SniffLimitErr
+		}
+		if len(p) > remain {
+			p = p[:remain]
+		}
+	}
+
 	sn, sErr := s.source.Read(p)
+	if sErr != nil && s.sniffing && s.sniffErr == nil {
+		s.sniffErr = sErr
+	}
 	if sn > 0 && s.sniffing {
+		s.matcherRead += sn
 		s.lastErr = sErr
 		if wn, wErr := s.buffer.Write(p[:sn]); wErr != nil {
 			return wn, wErr
@@ -47,5 +87,122 @@ func (s *bufferedReader) Read(p []byte) (int, error) {
 func (s *bufferedReader) reset(snif bool) {
 	s.sniffing = snif
 	s.bufferRead = 0
+	s.matcherRead = 0
 	s.bufferSize = s.buffer.Len()
 }
+
+// discard 丢弃已缓存数据的前 n 个字节, 之后的读取从剩余数据开始
+func (s *bufferedReader) discard(n int) {
+	s.buffer.Next(n)
+	s.reset(s.sniffing)
+}
+
+// sniffer 返回用于组合匹配器的可回退读取器, 若 r 已是嗅探中的 bufferedReader 则直接复用
+func sniffer(r io.Reader) *bufferedReader {
+	if br, ok := r.(*bufferedReader); ok && br.sniffing {
+		return br
+	}
+	return &bufferedReader{source: r, sniffing: true}
+}
+
+// rewind 回到嗅探数据的起始处, 使下一个匹配器能够读取到相同的数据
+func (s *bufferedReader) rewind() io.Reader {
+	s.reset(true)
+	return s
+}
+
+// sniffed 返回嗅探阶段缓存的数据的副本
+func (s *bufferedReader) sniffed() []byte {
+	return append([]byte(nil), s.buffer.Bytes()...)
+}
+
+// sniffWriter 为嗅探阶段提供给匹配器的写入端
+type sniffWriter struct {
+	w            io.Writer
+	settingsSent bool // 是否已向客户端发送过 HTTP2 SETTINGS 帧
+}
+
+func (s *sniffWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+// discarding 返回写入是否被丢弃, 使用 WithReadOnlyMatchers 时客户端收不到匹配器写入的数据
+func (s *sniffWriter) discarding() bool {
+	return s.w == ioutil.Discard
+}
+
+// settingsAckFilter 从客户端数据中去掉第一个 SETTINGS ACK 帧。
+// 匹配器在嗅探阶段发送的 SETTINGS 帧对后续的服务端不可见, 若将客户端对它的 ACK 交给服务端,
+// 服务端会把它当作对自身 SETTINGS 的确认, 导致多出一个 ACK 时出现协议错误
+type settingsAckFilter struct {
+	r       io.Reader
+	preface int // 尚未透传的 preface 字节数
+	remain  int // 当前帧尚未透传的负载字节数
+	hdr     [9]byte
+	hdrN    int
+	pending []byte // 待透传的帧头
+	done    bool
+}
+
+func newSettingsAckFilter(r io.Reader) *settingsAckFilter {
+	return &settingsAckFilter{r: r, preface: len(http2.ClientPreface)}
+}
+
+func (f *settingsAckFilter) Read(p []byte) (int, error) {
+	for {
+		if len(f.pending) > 0 {
+			n := copy(p, f.pending)
+			f.pending = f.pending[n:]
+			return n, nil
+		}
+		if f.done {
+			return f.r.Read(p)
+		}
+		if f.preface > 0 || f.remain > 0 {
+			left := &f.preface
+			if f.preface == 0 {
+				left = &f.remain
+			}
+			if len(p) > *left {
+				p = p[:*left]
+			}
+			n, err := f.r.Read(p)
+			*left -= n
+			return n, err
+		}
+
+		n, err := f.r.Read(f.hdr[f.hdrN:])
+		f.hdrN += n
+		if f.hdrN == len(f.hdr) {
+			f.hdrN = 0
+			length := int(f.hdr[0])<<16 | int(f.hdr[1])<<8 | int(f.hdr[2])
+			typ, flags := http2.FrameType(f.hdr[3]), http2.Flags(f.hdr[4])
+			if typ == http2.FrameSettings && flags.Has(http2.FlagSettingsAck) && length == 0 {
+				f.done = true
+			} else {
+				f.pending = append(f.pending[:0], f.hdr[:]...)
+				f.remain = length
+			}
+		}
+		if err != nil && len(f.pending) == 0 {
+			return 0, err
+		}
+	}
+}
+
+// guardedReader 为只读匹配器提供的读取端, 失效后读取总是返回 io.EOF
+type guardedReader struct {
+	r       io.Reader
+	invalid int32
+}
+
+func (g *guardedReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&g.invalid) != 0 {
+		return 0, io.EOF
+	}
+	return g.r.Read(p)
+}
+
+func (g *guardedReader) invalidate() {
+	atomic.StoreInt32(&g.invalid, 1)
+}
@@ -2,8 +2,13 @@ package mini_cmux
 
 import (
 	"bufio"
+	"bytes"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"regexp"
+	"strings"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
@@ -12,12 +17,236 @@ import (
 // HTTP1HeaderField 返回一个匹配 HTTP 1 连接的第一个请求的头字段的匹配器。
 func HTTP1HeaderField(name, value string) MatchWriter {
 	return func(w io.Writer, r io.Reader) bool {
-		req, err := http.ReadRequest(bufio.NewReader(r))
+		return matchHTTP1(r, func(req *http.Request) bool {
+			return req.Header.Get(name) == value
+		})
+	}
+}
+
+// HTTP1Method 返回一个匹配 HTTP 1 连接的第一个请求的方法的匹配器
+func HTTP1Method(methods ...string) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP1(r, func(req *http.Request) bool {
+			for _, method := range methods {
+				if req.Method == method {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
+
+// HTTP1Path 返回一个精确匹配 HTTP 1 连接的第一个请求的路径的匹配器
+func HTTP1Path(paths ...string) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP1(r, func(req *http.Request) bool {
+			for _, path := range paths {
+				if req.URL.Path == path {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
+
+// HTTP1PathPrefix 返回一个按前缀匹配 HTTP 1 连接的第一个请求的路径的匹配器,
+// 如 "/admin/" 匹配 "/admin/users"
+func HTTP1PathPrefix(prefixes ...string) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP1(r, func(req *http.Request) bool {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(req.URL.Path, prefix) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
+
+// HTTP1PathRegexp 返回一个按正则表达式匹配 HTTP 1 连接的第一个请求的路径的匹配器
+func HTTP1PathRegexp(expr *regexp.Regexp) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP1(r, func(req *http.Request) bool {
+			return expr.MatchString(req.URL.Path)
+		})
+	}
+}
+
+// HTTP1Host 返回一个匹配 HTTP 1 连接的第一个请求的 Host 的匹配器, 忽略大小写与端口号,
+// 支持 "*.example.com" 形式的通配符
+func HTTP1Host(hosts ...string) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP1(r, func(req *http.Request) bool {
+			host := req.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return matchHostName(host, hosts)
+		})
+	}
+}
+
+// HTTP1Upgrade 返回一个匹配 HTTP 1 协议升级请求的匹配器, 请求的 Connection 头需包含 upgrade,
+// Upgrade 头中任意一个协议与 protocols 匹配(忽略大小写)即匹配, 未传入 protocols 时匹配任意升级请求
+func HTTP1Upgrade(protocols ...string) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP1(r, func(req *http.Request) bool {
+			return isUpgradeRequest(req, protocols)
+		})
+	}
+}
+
+// H2CUpgrade 返回一个匹配 h2c 升级请求(RFC 7540 3.2)的匹配器, 请求需携带 HTTP2-Settings 头
+func H2CUpgrade() MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP1(r, func(req *http.Request) bool {
+			return isUpgradeRequest(req, []string{"h2c"}) &&
+				headerHasToken(req.Header, "Connection", "HTTP2-Settings") &&
+				len(req.Header.Values("HTTP2-Settings")) == 1
+		})
+	}
+}
+
+// WebSocket 返回一个匹配 WebSocket 握手请求(RFC 6455 4.1)的匹配器,
+// 请求需为携带 Sec-WebSocket-Key 的 GET 请求
+func WebSocket() MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP1(r, func(req *http.Request) bool {
+			return req.Method == http.MethodGet &&
+				isUpgradeRequest(req, []string{"websocket"}) &&
+				req.Header.Get("Sec-WebSocket-Key") != ""
+		})
+	}
+}
+
+func isUpgradeRequest(req *http.Request, protocols []string) bool {
+	if !headerHasToken(req.Header, "Connection", "upgrade") {
+		return false
+	}
+	if len(protocols) == 0 {
+		return req.Header.Get("Upgrade") != ""
+	}
+	for _, proto := range protocols {
+		if headerHasToken(req.Header, "Upgrade", proto) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerHasToken 判断以逗号分隔的请求头中是否包含 token, 忽略大小写,
+// Upgrade 头中 "websocket/13" 形式的协议版本号不参与比较
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			t = strings.TrimSpace(t)
+			if i := strings.IndexByte(t, '/'); i >= 0 && strings.IndexByte(token, '/') < 0 {
+				t = t[:i]
+			}
+			if strings.EqualFold(t, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchHTTP1 读取 HTTP 1 连接的第一个请求并交给 matches 判断
+func matchHTTP1(r io.Reader, matches func(*http.Request) bool) bool {
+	req, err := http.ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		return false
+	}
+	return matches(req)
+}
+
+// 请求行的最大长度, 超出后视为不匹配
+const maxHTTP1RequestLineLen = 4096
+
+var defaultHTTP1Methods = []string{
+	http.MethodOptions,
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodDelete,
+	http.MethodTrace,
+	http.MethodConnect,
+	http.MethodPatch,
+}
+
+// HTTP1Fast 返回一个只根据请求行匹配 HTTP 1 连接的匹配器, 不解析请求头。
+// 请求行需以已知的方法开头并以 HTTP/1.x 结尾, extMethods 为额外允许的方法
+func HTTP1Fast(extMethods ...string) MatchWriter {
+	methods := append(append([]string(nil), defaultHTTP1Methods...), extMethods...)
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP1RequestLine(r, methods)
+	}
+}
+
+// HTTPConnect 返回一个匹配 HTTP 1 CONNECT 请求的匹配器, 只检查请求行。
+// HTTP1Fast 同样会匹配 CONNECT 请求, 需要先于 HTTP1Fast 注册
+func HTTPConnect() MatchWriter {
+	methods := []string{http.MethodConnect}
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP1RequestLine(r, methods)
+	}
+}
+
+// matchHTTP1RequestLine 读取请求行并检查方法与版本号, 方法不匹配时在读到空格前即返回
+func matchHTTP1RequestLine(r io.Reader, methods []string) bool {
+	var buf [maxHTTP1RequestLineLen]byte
+	n, methodEnd := 0, -1
+	for n < len(buf) {
+		rn, err := r.Read(buf[n:])
+		n += rn
+		line := buf[:n]
+		if methodEnd < 0 {
+			if i := bytes.IndexByte(line, ' '); i >= 0 {
+				if !hasMethod(methods, line[:i], false) {
+					return false
+				}
+				methodEnd = i
+			} else if !hasMethod(methods, line, true) {
+				return false
+			}
+		}
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			return methodEnd >= 0 && isHTTP1RequestLine(line[methodEnd:i])
+		}
 		if err != nil {
 			return false
 		}
-		return req.Header.Get(name) == value
 	}
+	return false
+}
+
+// hasMethod 检查 b 是否为 methods 中的方法, prefix 为 true 时检查 b 是否为某个方法的前缀
+func hasMethod(methods []string, b []byte, prefix bool) bool {
+	for _, m := range methods {
+		if prefix && len(b) <= len(m) && m[:len(b)] == string(b) {
+			return true
+		}
+		if !prefix && m == string(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHTTP1RequestLine 检查方法之后的 " URI HTTP/1.x\r" 部分
+func isHTTP1RequestLine(b []byte) bool {
+	b = bytes.TrimSuffix(b, []byte("\r"))
+	i := bytes.LastIndexByte(b, ' ')
+	if i <= 1 {
+		return false
+	}
+	version := b[i+1:]
+	return len(version) == len("HTTP/1.1") && bytes.HasPrefix(version, []byte("HTTP/1.")) &&
+		version[7] >= '0' && version[7] <= '9'
 }
 
 // Any 匹配任意请求的匹配器
@@ -25,7 +254,70 @@ func Any() MatchWriter {
 	return func(w io.Writer, r io.Reader) bool { return true }
 }
 
+// And 返回一个在所有匹配器均匹配时才匹配的匹配器, 每个匹配器都从嗅探数据的起始处读取
+func And(matchers ...MatchWriter) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		br := sniffer(r)
+		for _, m := range matchers {
+			if !m(w, br.rewind()) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or 返回一个任意匹配器匹配即匹配的匹配器, 每个匹配器都从嗅探数据的起始处读取
+func Or(matchers ...MatchWriter) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		br := sniffer(r)
+		for _, m := range matchers {
+			if m(w, br.rewind()) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not 返回一个对传入匹配器的结果取反的匹配器
+func Not(matcher MatchWriter) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return !matcher(w, r)
+	}
+}
+
+// ReadOnly 返回一个禁止写入的匹配器, 传入匹配器向连接写入的数据会被丢弃,
+// 使其在匹配失败时不会对连接产生副作用。
+// 包装 HTTP2 请求头匹配器时, 只能匹配不等待服务端 SETTINGS 帧即发送请求头的客户端
+// (如 Go 的 http2.Transport), grpc-go 客户端需要使用未包装的匹配器
+func ReadOnly(matcher MatchWriter) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matcher(ioutil.Discard, r)
+	}
+}
+
+// readOnlyMatcher 将只读匹配器包装为 MatchWriter, 匹配器只能读取嗅探数据,
+// 且在匹配器返回后读取端即失效, 无法在之后继续读取连接
+func readOnlyMatcher(matcher Matcher) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		gr := &guardedReader{r: r}
+		defer gr.invalidate()
+		return matcher(gr)
+	}
+}
+
+// HTTP2 返回一个只检查 HTTP2 连接 preface 的匹配器, 可以匹配不使用 TLS 直接发送 HTTP2 的
+// (prior knowledge) 客户端, 不读取请求头也不会向连接写入数据
+func HTTP2() MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return hasHTTP2Preface(r)
+	}
+}
+
 // HTTP2HeaderField 返回一个匹配 HTTP2 连接的第一个请求的头字段的匹配器。
+// 与其他 HTTP2 请求头匹配器一样, 会在收到客户端的 SETTINGS 帧后向连接写入 SETTINGS 帧,
+// 以便等待服务端 SETTINGS 的客户端继续发送请求头
 func HTTP2HeaderField(name, value string) MatchWriter {
 	return func(w io.Writer, r io.Reader) bool {
 		return matchHTTP2Field(w, r, name, func(gotValue string) bool {
@@ -34,6 +326,163 @@ func HTTP2HeaderField(name, value string) MatchWriter {
 	}
 }
 
+// HTTP2HeaderFieldPrefix 返回一个按前缀匹配 HTTP2 连接的第一个请求的头字段的匹配器
+func HTTP2HeaderFieldPrefix(name, prefix string) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP2Field(w, r, name, func(gotValue string) bool {
+			return strings.HasPrefix(gotValue, prefix)
+		})
+	}
+}
+
+// HTTP2HeaderFieldRegexp 返回一个按正则表达式匹配 HTTP2 连接的第一个请求的头字段的匹配器
+func HTTP2HeaderFieldRegexp(name string, expr *regexp.Regexp) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP2Field(w, r, name, expr.MatchString)
+	}
+}
+
+// HTTP2Path 返回一个精确匹配 HTTP2 连接的第一个请求的 :path 的匹配器,
+// 如 "/grpc.HelloGRPC/RequestStop"。
+// 由于一个 HTTP2 连接上会复用多个请求, 整个连接都会交给第一个请求匹配的监听器
+func HTTP2Path(paths ...string) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP2Field(w, r, ":path", func(gotValue string) bool {
+			for _, path := range paths {
+				if gotValue == path {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
+
+// HTTP2PathPrefix 返回一个按前缀匹配 HTTP2 连接的第一个请求的 :path 的匹配器,
+// 如 "/grpc.HelloGRPC/" 匹配该 gRPC 服务的所有方法
+func HTTP2PathPrefix(prefixes ...string) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP2Field(w, r, ":path", func(gotValue string) bool {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(gotValue, prefix) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
+
+// HTTP2Authority 返回一个匹配 HTTP2 连接的第一个请求的 :authority 的匹配器,
+// 忽略大小写与端口号, 支持 "*.example.com" 形式的通配符
+func HTTP2Authority(hosts ...string) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchHTTP2Field(w, r, ":authority", func(gotValue string) bool {
+			if h, _, err := net.SplitHostPort(gotValue); err == nil {
+				gotValue = h
+			}
+			return matchHostName(gotValue, hosts)
+		})
+	}
+}
+
+// TLS 返回一个匹配 TLS 握手连接的匹配器, 只解析 ClientHello 而不消费连接数据。
+// 传入 versions 时(如 tls.VersionTLS12), 仅匹配客户端支持的最高版本在其中的连接
+func TLS(versions ...uint16) MatchWriter {
+	return TLSClientHello(func(hello *ClientHello) bool {
+		if len(versions) == 0 {
+			return true
+		}
+		max := hello.MaxVersion()
+		for _, v := range versions {
+			if v == max {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// TLSClientHello 返回一个根据嗅探到的 ClientHello 进行匹配的匹配器
+func TLSClientHello(matches func(*ClientHello) bool) MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		hello, err := readClientHello(r)
+		if err != nil {
+			return false
+		}
+		return matches(hello)
+	}
+}
+
+// TLSServerName 返回一个按 SNI 主机名匹配 TLS 连接的匹配器, 忽略大小写。
+// 支持精确匹配与 "*.example.com" 形式的通配符(仅匹配一级子域名)
+func TLSServerName(names ...string) MatchWriter {
+	return TLSClientHello(func(hello *ClientHello) bool {
+		return matchHostName(hello.ServerName, names)
+	})
+}
+
+// TLSServerNameSuffix 返回一个按 SNI 主机名后缀匹配 TLS 连接的匹配器,
+// 后缀按域名层级比较, 如 "example.com" 匹配 "example.com" 与 "a.b.example.com"
+func TLSServerNameSuffix(suffixes ...string) MatchWriter {
+	return TLSClientHello(func(hello *ClientHello) bool {
+		sni := normalizeHost(hello.ServerName)
+		if sni == "" {
+			return false
+		}
+		for _, suffix := range suffixes {
+			suffix = strings.TrimPrefix(normalizeHost(suffix), ".")
+			if sni == suffix || strings.HasSuffix(sni, "."+suffix) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// TLSALPN 返回一个按 ALPN 协议列表匹配 TLS 连接的匹配器, 客户端提供的协议中
+// 任意一个在 protos 中即匹配。客户端通常同时提供 "h2" 与 "http/1.1",
+// 因此需要先注册 "h2" 的匹配器再注册 "http/1.1" 的匹配器
+func TLSALPN(protos ...string) MatchWriter {
+	return TLSClientHello(func(hello *ClientHello) bool {
+		for _, offered := range hello.ALPN {
+			for _, proto := range protos {
+				if offered == proto {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// matchHostName 检查 host 是否与 names 中的某个主机名精确或通配符匹配
+func matchHostName(host string, names []string) bool {
+	host = normalizeHost(host)
+	if host == "" {
+		return false
+	}
+	for _, name := range names {
+		name = normalizeHost(name)
+		if strings.HasPrefix(name, "*.") {
+			i := strings.IndexByte(host, '.')
+			if i > 0 && host[i+1:] == name[2:] {
+				return true
+			}
+			continue
+		}
+		if host == name {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHost 统一主机名的大小写并去掉末尾的根域名点
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
 func matchHTTP2Field(w io.Writer, r io.Reader, name string, matches func(string) bool) (matched bool) {
 	if !hasHTTP2Preface(r) {
 		return false
@@ -62,9 +511,18 @@ func matchHTTP2Field(w io.Writer, r io.Reader, name string, matches func(string)
 			if f.IsAck() {
 				break
 			}
+			// 每个连接只发送一次 SETTINGS, 避免多个匹配器重复写入
+			sw, _ := w.(*sniffWriter)
+			if sw != nil && sw.settingsSent {
+				break
+			}
 			if err := framer.WriteSettings(); err != nil {
 				return false
 			}
+			// 只有 SETTINGS 确实发送给了客户端, 才需要去掉客户端对它的 ACK
+			if sw != nil && !sw.discarding() {
+				sw.settingsSent = true
+			}
 		case *http2.ContinuationFrame:
 			if _, err := hdec.Write(f.HeaderBlockFragment()); err != nil {
 				return false
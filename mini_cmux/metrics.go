@@ -0,0 +1,86 @@
+package mini_cmux
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PrometheusContentType 为 WritePrometheus 输出内容的 Content-Type
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus 将统计数据以 Prometheus 文本格式写入 w
+func (s Stats) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	listenerCounter := func(name, help string, value func(ListenerStats) uint64) {
+		writeHeader(bw, name, help, "counter")
+		for _, l := range s.Listeners {
+			fmt.Fprintf(bw, "%s{listener=\"%s\"} %d\n", name, labelValueReplacer.Replace(l.Name), value(l))
+		}
+	}
+	listenerCounter("mini_cmux_connections_matched_total", "Connections matched by the listener's matchers.",
+		func(l ListenerStats) uint64 { return l.Matched })
+	listenerCounter("mini_cmux_connections_dispatched_total", "Connections put into the listener's queue.",
+		func(l ListenerStats) uint64 { return l.Dispatched })
+	listenerCounter("mini_cmux_connections_dropped_total", "Connections closed because the listener or the mux was closed.",
+		func(l ListenerStats) uint64 { return l.Dropped })
+	listenerCounter("mini_cmux_connections_limited_total", "Connections closed because the listener reached its connection limit.",
+		func(l ListenerStats) uint64 { return l.Limited })
+
+	writeHeader(bw, "mini_cmux_connections_overflow_total", "Connections that found the listener's queue full, by outcome.", "counter")
+	for _, l := range s.Listeners {
+		name := labelValueReplacer.Replace(l.Name)
+		fmt.Fprintf(bw, "mini_cmux_connections_overflow_total{listener=\"%s\",outcome=\"rejected\"} %d\n", name, l.Rejected)
+		fmt.Fprintf(bw, "mini_cmux_connections_overflow_total{listener=\"%s\",outcome=\"timeout\"} %d\n", name, l.TimedOut)
+		fmt.Fprintf(bw, "mini_cmux_connections_overflow_total{listener=\"%s\",outcome=\"spilled\"} %d\n", name, l.Spilled)
+	}
+
+	writeHeader(bw, "mini_cmux_listener_queue_length", "Connections waiting in the listener's queue.", "gauge")
+	for _, l := range s.Listeners {
+		fmt.Fprintf(bw, "mini_cmux_listener_queue_length{listener=\"%s\"} %d\n", labelValueReplacer.Replace(l.Name), l.QueueLen)
+	}
+
+	writeHeader(bw, "mini_cmux_listener_connections", "Live connections of listeners with a connection limit.", "gauge")
+	for _, l := range s.Listeners {
+		fmt.Fprintf(bw, "mini_cmux_listener_connections{listener=\"%s\"} %d\n", labelValueReplacer.Replace(l.Name), l.Active)
+	}
+
+	writeHeader(bw, "mini_cmux_connections_rejected_total", "Connections closed on accept by admission limits, by reason.", "counter")
+	fmt.Fprintf(bw, "mini_cmux_connections_rejected_total{reason=\"sniffing\"} %d\n", s.SniffLimited)
+	fmt.Fprintf(bw, "mini_cmux_connections_rejected_total{reason=\"per_ip\"} %d\n", s.IPLimited)
+	fmt.Fprintf(bw, "mini_cmux_connections_rejected_total{reason=\"rate\"} %d\n", s.RateLimited)
+
+	writeHeader(bw, "mini_cmux_connections_delayed_total", "Connections delayed before sniffing by the accept rate limit.", "counter")
+	fmt.Fprintf(bw, "mini_cmux_connections_delayed_total %d\n", s.RateDelayed)
+
+	writeHeader(bw, "mini_cmux_connections_unmatched_total", "Connections not matched by any matcher.", "counter")
+	fmt.Fprintf(bw, "mini_cmux_connections_unmatched_total %d\n", s.Unmatched)
+
+	writeHeader(bw, "mini_cmux_sniff_errors_total", "Connections whose sniffing failed, by reason.", "counter")
+	fmt.Fprintf(bw, "mini_cmux_sniff_errors_total{reason=\"timeout\"} %d\n", s.SniffTimeouts)
+	fmt.Fprintf(bw, "mini_cmux_sniff_errors_total{reason=\"overflow\"} %d\n", s.SniffOverflows)
+	fmt.Fprintf(bw, "mini_cmux_sniff_errors_total{reason=\"other\"} %d\n", s.SniffErrors-s.SniffTimeouts-s.SniffOverflows)
+
+	writeHeader(bw, "mini_cmux_sniffing_connections", "Connections currently being sniffed.", "gauge")
+	fmt.Fprintf(bw, "mini_cmux_sniffing_connections %d\n", s.Sniffing)
+
+	h := s.SniffLatency
+	writeHeader(bw, "mini_cmux_sniff_duration_seconds", "Time from accepting a connection to the routing decision.", "histogram")
+	for i, le := range h.Buckets {
+		fmt.Fprintf(bw, "mini_cmux_sniff_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), h.Counts[i])
+	}
+	fmt.Fprintf(bw, "mini_cmux_sniff_duration_seconds_bucket{le=\"+Inf\"} %d\n", h.Count)
+	fmt.Fprintf(bw, "mini_cmux_sniff_duration_seconds_sum %s\n", strconv.FormatFloat(h.Sum, 'g', -1, 64))
+	fmt.Fprintf(bw, "mini_cmux_sniff_duration_seconds_count %d\n", h.Count)
+
+	return bw.Flush()
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
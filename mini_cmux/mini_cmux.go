@@ -1,76 +1,345 @@
 package mini_cmux
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Matcher 为只读匹配器, 只能读取嗅探数据而无法访问连接本身,
+// 适用于第三方编写的匹配器。只读匹配器总是先于 MatchWriter 运行
 type Matcher func(io.Reader) bool
 
 var ServerCloseErr = errors.New("server close")
 
 var ConnError = errors.New("conn error")
 
+var ListenerCloseErr = errors.New("listener close")
+
+var NotMatchErr = errors.New("no matcher matched")
+
+var ServingErr = errors.New("mux already serving")
+
+// MatchWriter 为可以向连接写入数据的匹配器, io.Writer 为连接本身, io.Reader 为嗅探数据。
+// 写入的数据会直接发送给客户端且无法撤回, 即使该匹配器最终匹配失败, 连接被后续匹配器匹配,
+// 客户端也已经收到了这些数据。因此匹配器只应写入协议握手所必需的数据:
+// 内置匹配器中只有 HTTP2 系列匹配器会写入(每个连接最多一个 SETTINGS 帧), 其余匹配器均为只读。
+// 客户端对该 SETTINGS 帧的 ACK 会被多路复用器去掉, 不会交给最终处理连接的服务。
+// 需要避免副作用时可以使用 ReadOnly 包装匹配器或使用 WithReadOnlyMatchers 创建多路复用器
 type MatchWriter func(io.Writer, io.Reader) bool
 
 // New 根据传入的net.listener实例化一个多路复用器
-func New(l net.Listener) CMux {
-	return &cMux{
+func New(l net.Listener, opts ...Option) CMux {
+	m := &cMux{
 		root:   l,
 		bufLen: 1024,
 		donec:  make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
 // CMux 是一个网络连接的多路复用器
 type CMux interface {
-	// Match 对匹配器进行匹配
-	Match(MatchWriter) net.Listener
-	// Serve 启动多路复用器
+	// Match 对匹配器进行匹配, 任意一个匹配器匹配即可
+	Match(...MatchWriter) net.Listener
+	// MatchNamed 对匹配器进行匹配, 返回的监听器地址携带 name 作为描述
+	MatchNamed(string, ...MatchWriter) net.Listener
+	// MatchReaders 对只读匹配器进行匹配, 任意一个匹配器匹配即可
+	MatchReaders(...Matcher) net.Listener
+	// MatchWriters 对可写入连接的匹配器进行匹配, 与 Match 相同
+	MatchWriters(...MatchWriter) net.Listener
+	// Register 注册匹配器并返回句柄, 可在多路复用器运行中注册与注销
+	Register(ListenerConfig, ...MatchWriter) *Handle
+	// RegisterReaders 注册只读匹配器并返回句柄
+	RegisterReaders(ListenerConfig, ...Matcher) *Handle
+	// MatchTLS 匹配 TLS 连接并完成 TLS 终止, 返回用于匹配解密后数据的 CMux,
+	// 返回的 CMux 随所属多路复用器一起启动, 不需要再调用其 Serve
+	MatchTLS(*tls.Config, ...MatchWriter) CMux
+	// Default 返回接收未匹配连接的兜底监听器
+	Default() net.Listener
+	// MatchServerFirst 返回接收在等待时间内未发送任何数据的连接的监听器
+	MatchServerFirst(time.Duration) net.Listener
+	// Serve 启动多路复用器, 已经启动时返回 ServingErr
 	Serve() error
 	// Close 关闭多路复用器
 	Close()
+	// Stats 返回多路复用器的统计数据
+	Stats() Stats
 }
 
 type matchersListener struct {
-	ss MatchWriter
-	l  muxListener
+	rs []MatchWriter // 只读匹配器, 不会接收到连接的写入端
+	ss []MatchWriter
+	l  *muxListener
 }
 
 type cMux struct {
-	root   net.Listener
-	bufLen int                // 匹配器中缓存连接的队列长度
-	sls    []matchersListener // 注册的匹配器列表
-	donec  chan struct{}      // 多路复用器关闭channel
-	mu     sync.Mutex
+	stats             stats               // 统计数据, 需保证64位对齐
+	root              net.Listener        // 根监听器
+	bufLen            int                 // 匹配器中缓存连接的队列长度
+	sls               []*matchersListener // 注册的匹配器列表, 写时复制
+	donec             chan struct{}       // 多路复用器关闭channel
+	tlsc              []*cMux             // TLS 终止后进行二次匹配的多路复用器
+	sniffTimeout      time.Duration       // 嗅探阶段的读超时
+	maxSniffBytes     int                 // 嗅探阶段最多缓存的总字节数
+	matcherSniffBytes int                 // 每个匹配器最多读取的字节数
+	readOnly          bool                // 是否禁止匹配器向连接写入数据
+	proxyProtocol     bool                // 是否解析 PROXY protocol 头
+	trustedProxies    []*net.IPNet        // 允许发送 PROXY 头的来源网段
+	notFound          NotFoundHandler     // 未匹配连接的处理函数
+	defaultL          *muxListener        // 接收未匹配连接的兜底监听器
+	serverFirstL      *muxListener        // 接收未发送数据的连接的监听器
+	serverFirstWindow time.Duration       // 等待客户端发送数据的时间
+	serving           bool                // 是否已调用 Serve
+	registered        int                 // 已注册的监听器个数, 用于生成统计数据中的名称
+	maxSniffing       int                 // 同时进行匹配的最大连接数
+	maxConnsPerIP     int                 // 每个来源 IP 的最大连接数
+	maxListenerConns  int                 // 每个监听器的默认最大连接数
+	ipConns           map[string]int      // 各来源 IP 的当前连接数
+	ipMu              sync.Mutex          // 保护 ipConns
+	rateLimiter       *rateLimiter        // 按来源 IP 限制接收连接的速率
+	mu                sync.RWMutex
+}
+
+// ListenerConfig 为注册匹配器时对应监听器的配置
+type ListenerConfig struct {
+	Name      string // 监听器名称, 作为 Addr() 的描述
+	QueueSize int    // 连接队列长度, 为 0 时使用多路复用器的默认值
+	MaxConns  int    // 最大连接数, 包括队列中的连接与已被 Accept 但未关闭的连接, 为 0 时使用多路复用器的默认值
+
+	// 连接队列已满(服务未及时调用 Accept)时的处理策略, 默认为 OverflowBlock
+	Overflow     OverflowPolicy
+	BlockTimeout time.Duration // OverflowBlock 时的最长等待时间, 超时后关闭连接, 为 0 时一直等待
+	Fallback     net.Listener  // OverflowSpill 时接收溢出连接的监听器, 须为同一多路复用器返回的监听器, 否则注册时 panic
+}
+
+// OverflowPolicy 为监听器连接队列已满时的处理策略
+type OverflowPolicy int
+
+const (
+	// OverflowBlock 等待队列空出位置, 可通过 BlockTimeout 限制等待时间
+	OverflowBlock OverflowPolicy = iota
+	// OverflowReject 立即关闭连接
+	OverflowReject
+	// OverflowSpill 将连接交给 Fallback 监听器, 连接改为占用 Fallback 的连接名额,
+	// Fallback 的队列同样已满或连接数达到上限时关闭连接
+	OverflowSpill
+)
+
+// Handle 为注册到多路复用器中的匹配器的句柄
+type Handle struct {
+	m  *cMux
+	sl *matchersListener
+}
+
+// Listener 返回与匹配器对应的监听器
+func (h *Handle) Listener() net.Listener {
+	return h.sl.l
+}
+
+// Unregister 从多路复用器中注销匹配器并关闭对应的监听器,
+// 正在匹配中的连接不会再被分发到该监听器
+func (h *Handle) Unregister() {
+	h.m.unregister(h.sl)
+	_ = h.sl.l.Close()
 }
 
 // Match 对传入的 MatchWriter 进行包装成 muxListener，muxListener实现了 net.Listener 接口
-// 用于返回给与匹配器对应的服务端进行连接的获取、处理和关闭等操作
-func (m *cMux) Match(matchers MatchWriter) net.Listener {
-	ml := muxListener{
-		Listener: m.root,
-		connc:    make(chan net.Conn, m.bufLen),
-		donec:    make(chan struct{}),
+// 用于返回给与匹配器对应的服务端进行连接的获取、处理和关闭等操作。
+// 传入多个匹配器时按顺序尝试, 任意一个匹配即可(OR 语义), 更复杂的规则可使用 And/Or/Not 组合
+func (m *cMux) Match(matchers ...MatchWriter) net.Listener {
+	return m.MatchNamed("", matchers...)
+}
+
+// MatchReaders 对传入的只读匹配器进行包装成 muxListener, 任意一个匹配器匹配即可。
+// 只读匹配器总是先于 MatchWriter 运行, 因此交给其对应服务的连接不会被其他匹配器写入数据
+func (m *cMux) MatchReaders(matchers ...Matcher) net.Listener {
+	return m.RegisterReaders(ListenerConfig{}, matchers...).Listener()
+}
+
+// MatchWriters 与 Match 相同
+func (m *cMux) MatchWriters(matchers ...MatchWriter) net.Listener {
+	return m.Match(matchers...)
+}
+
+// MatchNamed 与 Match 相同, 返回的监听器的 Addr() 为携带 name 的 MuxAddr,
+// 便于在日志等场景中区分共用同一端口的各个服务
+func (m *cMux) MatchNamed(name string, matchers ...MatchWriter) net.Listener {
+	return m.Register(ListenerConfig{Name: name}, matchers...).Listener()
+}
+
+// Register 注册匹配器并返回句柄, 是并发安全的, 可以在 Serve 之后动态注册,
+// 新注册的匹配器只对之后开始匹配的连接生效
+func (m *cMux) Register(cfg ListenerConfig, matchers ...MatchWriter) *Handle {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &Handle{m: m, sl: m.register(cfg, nil, matchers)}
+}
+
+// RegisterReaders 与 Register 相同, 注册的是只读匹配器
+func (m *cMux) RegisterReaders(cfg ListenerConfig, matchers ...Matcher) *Handle {
+	rs := make([]MatchWriter, 0, len(matchers))
+	for _, matcher := range matchers {
+		rs = append(rs, readOnlyMatcher(matcher))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &Handle{m: m, sl: m.register(cfg, rs, nil)}
+}
+
+// register 在持有锁的情况下将匹配器添加到匹配器列表中
+func (m *cMux) register(cfg ListenerConfig, rs, ss []MatchWriter) *matchersListener {
+	// 无法转交的溢出连接只能被关闭, 属于配置错误, 不能静默地退化为 OverflowReject
+	fallback, ok := cfg.Fallback.(*muxListener)
+	if (cfg.Fallback != nil || cfg.Overflow == OverflowSpill) && (!ok || fallback.mdonec != m.donec) {
+		panic("mini_cmux: Fallback must be a listener returned by the same mux")
+	}
+	m.registered++
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = m.bufLen
+	}
+	maxConns := cfg.MaxConns
+	if maxConns <= 0 {
+		maxConns = m.maxListenerConns
+	}
+	ml := &muxListener{
+		root:   m.root,
+		name:   cfg.Name,
+		label:  cfg.Name,
+		connc:  make(chan net.Conn, size),
+		donec:  make(chan struct{}),
+		mdonec: m.donec,
+
+		overflow:     cfg.Overflow,
+		blockTimeout: cfg.BlockTimeout,
+		maxConns:     int64(maxConns),
+		fallback:     fallback,
+	}
+	if ml.label == "" {
+		ml.label = strconv.Itoa(m.registered)
+	}
+	// 多路复用器已关闭时直接关闭监听器
+	select {
+	case <-m.donec:
+		_ = ml.Close()
+	default:
+	}
+	sl := &matchersListener{rs: rs, ss: ss, l: ml}
+	//将该muxListener添加到CMux匹配器列表中, 写时复制以免影响正在匹配的连接持有的列表
+	sls := make([]*matchersListener, len(m.sls), len(m.sls)+1)
+	copy(sls, m.sls)
+	m.sls = append(sls, sl)
+	return sl
+}
+
+func (m *cMux) unregister(sl *matchersListener) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sls := make([]*matchersListener, 0, len(m.sls))
+	for _, s := range m.sls {
+		if s != sl {
+			sls = append(sls, s)
+		}
 	}
-	//将该muxListener添加到CMux匹配器列表中
-	m.sls = append(m.sls, matchersListener{ss: matchers, l: ml})
-	return ml
+	m.sls = sls
+}
+
+// matchers 返回当前注册的匹配器列表的快照
+func (m *cMux) matchers() []*matchersListener {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sls
+}
+
+// MatchTLS 注册一个匹配 TLS 连接的匹配器, 匹配成功的连接由多路复用器使用 config 完成握手,
+// 然后在解密后的数据上按返回的 CMux 中注册的匹配器进行第二轮匹配。
+// matchers 为空时匹配所有 TLS 连接, 也可以传入 TLSServerName 等匹配器只终止部分连接。
+// 返回的 CMux 随当前多路复用器一起启动和关闭, 无需单独调用 Serve
+func (m *cMux) MatchTLS(config *tls.Config, matchers ...MatchWriter) CMux {
+	if len(matchers) == 0 {
+		matchers = []MatchWriter{TLS()}
+	}
+	ml := m.Match(matchers...).(*muxListener)
+	tm := &cMux{
+		root:         tlsListener{muxListener: ml, config: config},
+		bufLen:       m.bufLen,
+		donec:        make(chan struct{}),
+		sniffTimeout: m.sniffTimeout,
+
+		maxSniffBytes:     m.maxSniffBytes,
+		matcherSniffBytes: m.matcherSniffBytes,
+		readOnly:          m.readOnly,
+		maxListenerConns:  m.maxListenerConns,
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tlsc = append(m.tlsc, tm)
+	// 多路复用器已在运行时直接启动
+	if m.serving {
+		go tm.Serve()
+	}
+	return tm
+}
+
+// Default 返回接收未匹配连接的兜底监听器, 多次调用返回同一个监听器。
+// 连接交给兜底监听器时嗅探到的数据会被重放, 嗅探超时或读取出错的连接不会交给兜底监听器
+func (m *cMux) Default() net.Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.defaultL == nil {
+		// 不携带匹配器的监听器不会参与匹配, 仅随多路复用器一起关闭
+		m.defaultL = m.register(ListenerConfig{Name: "default"}, nil, nil).l
+	}
+	return m.defaultL
+}
+
+// MatchServerFirst 用于 MySQL、SMTP 等由服务端先发送数据的协议:
+// 连接建立后(及去掉 PROXY 头后)在 window 内未发送任何数据的连接交给返回的监听器,
+// 发送了数据的连接继续进行正常的匹配。window 应小于嗅探超时, 多次调用时使用最后一次的 window
+func (m *cMux) MatchServerFirst(window time.Duration) net.Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.serverFirstL == nil {
+		m.serverFirstL = m.register(ListenerConfig{Name: "server-first"}, nil, nil).l
+	}
+	m.serverFirstWindow = window
+	return m.serverFirstL
 }
 
 func (m *cMux) Serve() error {
 	var wg sync.WaitGroup
 
+	// 同一多路复用器只能运行一个 Serve, 否则关闭时会重复关闭连接队列
+	m.mu.Lock()
+	if m.serving {
+		m.mu.Unlock()
+		return ServingErr
+	}
+	m.serving = true
+	for _, tm := range m.tlsc {
+		go tm.Serve()
+	}
+	m.mu.Unlock()
+
 	defer func() {
 		m.closeDoneChans()
 		wg.Wait()
 
-		for _, sl := range m.sls {
+		for _, sl := range m.matchers() {
 			close(sl.l.connc)
 			// 关闭各匹配器对应的连接队列
 			for c := range sl.l.connc {
+				atomic.AddUint64(&sl.l.stats.dropped, 1)
 				_ = c.Close()
 			}
 		}
@@ -81,33 +350,286 @@ func (m *cMux) Serve() error {
 		if err != nil {
 			return err
 		}
+		// 匹配之前按来源限制速率, 来自可信代理的连接在读取 PROXY 头后按客户端地址限制
+		var wait time.Duration
+		if m.rateLimiter != nil && !m.readsProxyHeader(c.RemoteAddr()) {
+			var ok bool
+			if wait, ok = m.reserveRate(c.RemoteAddr()); !ok {
+				_ = c.Close()
+				continue
+			}
+		}
+		release, ok := m.admit(c)
+		if !ok {
+			_ = c.Close()
+			continue
+		}
 
 		wg.Add(1)
-		go m.serve(c, m.donec, &wg)
+		go m.serve(c, wait, release, m.donec, &wg)
+	}
+}
+
+// admit 检查同时匹配的连接数与来源 IP 的连接数是否超出上限,
+// 未超出时计入正在匹配的连接数, release 需在连接关闭时调用
+func (m *cMux) admit(c net.Conn) (release func(), ok bool) {
+	release = func() {}
+	// 来自可信代理的连接在读取 PROXY 头后按客户端地址计算
+	if m.maxConnsPerIP > 0 && !m.readsProxyHeader(c.RemoteAddr()) {
+		if release, ok = m.acquireIP(c.RemoteAddr()); !ok {
+			atomic.AddUint64(&m.stats.ipLimited, 1)
+			return nil, false
+		}
+	}
+	// 只有 Serve 所在的协程会增加计数, 检查与增加之间不会有其他连接进入
+	if m.maxSniffing > 0 && atomic.LoadInt64(&m.stats.sniffing) >= int64(m.maxSniffing) {
+		atomic.AddUint64(&m.stats.sniffLimited, 1)
+		release()
+		return nil, false
 	}
+	atomic.AddInt64(&m.stats.sniffing, 1)
+	return release, true
 }
 
-func (m *cMux) serve(c net.Conn, donec <-chan struct{}, wg *sync.WaitGroup) {
+// acquireIP 占用来源 IP 的一个连接名额
+func (m *cMux) acquireIP(addr net.Addr) (func(), bool) {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	m.ipMu.Lock()
+	defer m.ipMu.Unlock()
+	if m.ipConns[ip] >= m.maxConnsPerIP {
+		return nil, false
+	}
+	if m.ipConns == nil {
+		m.ipConns = make(map[string]int)
+	}
+	m.ipConns[ip]++
+	return func() {
+		m.ipMu.Lock()
+		defer m.ipMu.Unlock()
+		if m.ipConns[ip]--; m.ipConns[ip] <= 0 {
+			delete(m.ipConns, ip)
+		}
+	}, true
+}
+
+func (m *cMux) serve(c net.Conn, wait time.Duration, release func(), donec <-chan struct{}, wg *sync.WaitGroup) {
 	defer wg.Done()
+	// 超出速率的连接等待可用令牌后再开始匹配
+	if wait > 0 && !waitRate(wait, donec) {
+		atomic.AddInt64(&m.stats.sniffing, -1)
+		release()
+		_ = c.Close()
+		return
+	}
+	start := time.Now()
 	// 将 net.Conn 包装为 MuxConn
 	muc := newMuxConn(c)
+	muc.onClose(release)
+	muc.buf.maxBytes = m.maxSniffBytes
+	muc.buf.matcherBytes = m.matcherSniffBytes
+	if m.readOnly {
+		muc.sw.w = ioutil.Discard
+	}
 
-	// 遍历已注册的匹配器列表
-	for _, sl := range m.sls {
-		matched := sl.ss(muc.Conn, muc.startSniffing())
-		if matched {
-			muc.doneSniffing()
-			select {
-			// 将匹配成功的连接放入匹配器的缓存队列中，结束
-			case sl.l.connc <- muc:
-				// 如果多路复用器标识为终止，则关闭连接，结束
-			case <-donec:
-				_ = c.Close()
+	// 为整个嗅探阶段设置读超时, 防止客户端不发送数据或缓慢发送数据时一直占用协程
+	if m.sniffTimeout > 0 {
+		_ = c.SetReadDeadline(start.Add(m.sniffTimeout))
+	}
+
+	m.mu.RLock()
+	sfl, window := m.serverFirstL, m.serverFirstWindow
+	m.mu.RUnlock()
+	if sfl != nil && m.serveServerFirst(muc, sfl, window, start, donec) {
+		return
+	}
+
+	// 匹配前去掉可信代理发送的 PROXY 头
+	if m.readsProxyHeader(c.RemoteAddr()) {
+		if err := muc.readProxyHeader(); err != nil {
+			if muc.buf.sniffErr == nil {
+				muc.buf.sniffErr = err
 			}
+			m.serveNotFound(muc, start, donec)
 			return
 		}
+		if m.rateLimiter != nil {
+			wait, ok := m.reserveRate(muc.RemoteAddr())
+			if !ok || wait > 0 && !waitRate(wait, donec) {
+				atomic.AddInt64(&m.stats.sniffing, -1)
+				_ = muc.Close()
+				return
+			}
+			// 等待令牌的时间不计入嗅探阶段
+			if wait > 0 {
+				start = start.Add(wait)
+				if m.sniffTimeout > 0 {
+					_ = muc.SetReadDeadline(start.Add(m.sniffTimeout))
+				}
+			}
+		}
+		if m.maxConnsPerIP > 0 {
+			ipRelease, ok := m.acquireIP(muc.RemoteAddr())
+			if !ok {
+				atomic.AddUint64(&m.stats.ipLimited, 1)
+				atomic.AddInt64(&m.stats.sniffing, -1)
+				_ = muc.Close()
+				return
+			}
+			muc.onClose(ipRelease)
+		}
+		// 代理发送 PROXY 头后客户端仍可能等待服务端先发送数据
+		if sfl != nil && m.serveServerFirst(muc, sfl, window, start, donec) {
+			return
+		}
+	}
+
+	// 遍历已注册的匹配器列表, 先运行所有只读匹配器, 再运行可写入连接的匹配器
+	sls := m.matchers()
+match:
+	for _, writers := range []bool{false, true} {
+		for _, sl := range sls {
+			// 跳过已被关闭的监听器
+			if sl.l.isClosed() {
+				continue
+			}
+			ss := sl.rs
+			if writers {
+				ss = sl.ss
+			}
+			for _, s := range ss {
+				matched := s(&muc.sw, muc.startSniffing())
+				if matched {
+					m.stats.sniffLatency.observe(time.Since(start))
+					atomic.AddUint64(&sl.l.stats.matched, 1)
+					m.doneSniffing(muc)
+					if m.sniffTimeout > 0 {
+						_ = c.SetReadDeadline(time.Time{})
+					}
+					dispatch(muc, sl.l, donec)
+					return
+				}
+				// 嗅探数据超出上限后不再继续匹配
+				if muc.buf.sniffErr == SniffLimitErr {
+					break match
+				}
+			}
+		}
+	}
+	m.serveNotFound(muc, start, donec)
+}
+
+// serveServerFirst 在 window 内等待客户端发送数据, 未收到数据时将连接交给 l 并返回 true
+func (m *cMux) serveServerFirst(muc *MuxConn, l *muxListener, window time.Duration, start time.Time, donec <-chan struct{}) bool {
+	if muc.clientSilent(window) && !l.isClosed() {
+		m.stats.sniffLatency.observe(time.Since(start))
+		atomic.AddUint64(&l.stats.matched, 1)
+		_ = muc.SetReadDeadline(time.Time{})
+		m.doneSniffing(muc)
+		dispatch(muc, l, donec)
+		return true
+	}
+	// 恢复嗅探阶段原有的读超时, 不因等待客户端而延长
+	if m.sniffTimeout > 0 {
+		_ = muc.SetReadDeadline(start.Add(m.sniffTimeout))
+	} else {
+		_ = muc.SetReadDeadline(time.Time{})
+	}
+	return false
+}
+
+// doneSniffing 在得出匹配结果后结束嗅探, 连接不再计入正在匹配的连接数,
+// 之后在队列或 NotFoundHandler 中的等待不会占用 WithMaxSniffing 的名额
+func (m *cMux) doneSniffing(muc *MuxConn) {
+	muc.doneSniffing()
+	atomic.AddInt64(&m.stats.sniffing, -1)
+}
+
+// serveNotFound 处理未被任何匹配器匹配的连接:
+// 先交给 NotFoundHandler, 未被处理时交给兜底监听器, 否则关闭连接
+func (m *cMux) serveNotFound(muc *MuxConn, start time.Time, donec <-chan struct{}) {
+	m.stats.sniffLatency.observe(time.Since(start))
+	err := muc.buf.sniffErr
+	if err != nil {
+		atomic.AddUint64(&m.stats.sniffErrors, 1)
+	}
+	switch {
+	case err == nil:
+		err = NotMatchErr
+	case isTimeout(err):
+		atomic.AddUint64(&m.stats.sniffTimeouts, 1)
+	case err == SniffLimitErr:
+		atomic.AddUint64(&m.stats.sniffOverflows, 1)
+	}
+	atomic.AddUint64(&m.stats.unmatched, 1)
+
+	prefix := muc.buf.sniffed()
+	m.doneSniffing(muc)
+	if m.sniffTimeout > 0 {
+		_ = muc.SetReadDeadline(time.Time{})
+	}
+	if m.notFound != nil && m.notFound(muc, prefix, err) {
+		return
+	}
+	m.mu.RLock()
+	dl := m.defaultL
+	m.mu.RUnlock()
+	// PROXY 头读取失败的连接数据中仍带有 PROXY 头, 不能交给兜底监听器
+	if dl != nil && muc.proxyErr == nil && (err == NotMatchErr || err == SniffLimitErr) {
+		dispatch(muc, dl, donec)
+		return
+	}
+	_ = muc.Close()
+}
+
+// dispatch 将连接放入监听器的缓存队列中, 队列已满时按监听器的溢出策略处理
+func dispatch(muc *MuxConn, l *muxListener, donec <-chan struct{}) {
+	if !l.take(muc) {
+		atomic.AddUint64(&l.stats.limited, 1)
+		_ = muc.Close()
+		return
+	}
+	if l.enqueue(muc) {
+		return
+	}
+	switch l.overflow {
+	case OverflowReject:
+		atomic.AddUint64(&l.stats.rejected, 1)
+		_ = muc.Close()
+		return
+	case OverflowSpill:
+		if l.spill(muc) {
+			atomic.AddUint64(&l.stats.spilled, 1)
+			return
+		}
+		atomic.AddUint64(&l.stats.rejected, 1)
+		_ = muc.Close()
+		return
+	}
+
+	var timeout <-chan time.Time
+	if l.blockTimeout > 0 {
+		t := time.NewTimer(l.blockTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	// 将匹配成功的连接放入匹配器的缓存队列中，结束
+	case l.connc <- muc:
+		l.enqueued()
+	case <-timeout:
+		atomic.AddUint64(&l.stats.timedOut, 1)
+		_ = muc.Close()
+		// 如果多路复用器或该监听器标识为终止，则关闭连接，结束
+	case <-l.donec:
+		atomic.AddUint64(&l.stats.dropped, 1)
+		_ = muc.Close()
+	case <-donec:
+		atomic.AddUint64(&l.stats.dropped, 1)
+		_ = muc.Close()
 	}
-	c.Close()
 }
 
 func (m *cMux) Close() {
@@ -125,22 +647,32 @@ func (m *cMux) closeDoneChans() {
 		close(m.donec)
 	}
 	for _, sl := range m.sls {
-		select {
-		case <-sl.l.donec:
-			// Already closed. Don't close again
-		default:
-			close(sl.l.donec)
-		}
+		_ = sl.l.Close()
+	}
+	for _, tm := range m.tlsc {
+		tm.Close()
 	}
 }
 
+// muxListener 为 Match 返回的监听器, 拥有独立于根监听器的关闭语义:
+// 关闭后仅停止向该监听器分发连接, 多路复用器与其他监听器不受影响
 type muxListener struct {
-	net.Listener
-	connc chan net.Conn
-	donec chan struct{}
+	stats  listenerStats // 统计数据, 需保证64位对齐
+	root   net.Listener
+	name   string
+	label  string // 统计数据中的名称, 未设置名称时为注册序号
+	connc  chan net.Conn
+	donec  chan struct{}
+	mdonec <-chan struct{} // 所属多路复用器的关闭channel
+	once   sync.Once
+
+	overflow     OverflowPolicy // 队列已满时的处理策略
+	blockTimeout time.Duration  // OverflowBlock 时的最长等待时间
+	fallback     *muxListener   // OverflowSpill 时接收溢出连接的监听器
+	maxConns     int64          // 最大连接数, 为 0 时不限制
 }
 
-func (l muxListener) Accept() (net.Conn, error) {
+func (l *muxListener) Accept() (net.Conn, error) {
 	select {
 	case c, ok := <-l.connc:
 		if !ok {
@@ -148,7 +680,146 @@ func (l muxListener) Accept() (net.Conn, error) {
 		}
 		return c, nil
 	case <-l.donec:
-		return nil, ServerCloseErr
+		select {
+		case <-l.mdonec:
+			return nil, ServerCloseErr
+		default:
+			return nil, ListenerCloseErr
+		}
+	}
+}
+
+// Close 关闭该监听器并关闭队列中尚未被 Accept 的连接, 不会关闭根监听器
+func (l *muxListener) Close() error {
+	l.once.Do(func() {
+		close(l.donec)
+		l.drain()
+	})
+	return nil
+}
+
+// Addr 返回携带监听器名称的虚拟地址
+func (l *muxListener) Addr() net.Addr {
+	var root net.Addr
+	if l.root != nil {
+		root = l.root.Addr()
+	}
+	return MuxAddr{Root: root, Name: l.name}
+}
+
+func (l *muxListener) isClosed() bool {
+	select {
+	case <-l.donec:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire 占用监听器的一个连接名额, 连接数达到上限时返回 false
+func (l *muxListener) acquire() bool {
+	if l.maxConns <= 0 {
+		return true
+	}
+	for {
+		n := atomic.LoadInt64(&l.stats.active)
+		if n >= l.maxConns {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.stats.active, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (l *muxListener) release() {
+	atomic.AddInt64(&l.stats.active, -1)
+}
+
+// take 为连接占用监听器的连接名额, 名额在连接关闭时释放
+func (l *muxListener) take(muc *MuxConn) bool {
+	if !l.acquire() {
+		return false
+	}
+	if l.maxConns > 0 {
+		muc.slot = l
+	}
+	return true
+}
+
+// spill 将连接交给 Fallback 监听器, 连接占用的名额随之转移到 Fallback
+func (l *muxListener) spill(muc *MuxConn) bool {
+	fl := l.fallback
+	if fl.isClosed() || !fl.acquire() {
+		return false
+	}
+	if muc.slot != nil {
+		muc.slot.release()
+		muc.slot = nil
+	}
+	if fl.maxConns > 0 {
+		muc.slot = fl
+	}
+	return fl.enqueue(muc)
+}
+
+// enqueue 在队列未满时放入连接并返回 true
+func (l *muxListener) enqueue(c net.Conn) bool {
+	select {
+	case l.connc <- c:
+		l.enqueued()
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueued 记录放入队列的连接, 放入队列的同时监听器被关闭时由此处清理队列
+func (l *muxListener) enqueued() {
+	atomic.AddUint64(&l.stats.dispatched, 1)
+	if l.isClosed() {
+		l.drain()
+	}
+}
+
+// drain 关闭队列中剩余的连接
+func (l *muxListener) drain() {
+	for {
+		select {
+		case c, ok := <-l.connc:
+			if !ok {
+				return
+			}
+			atomic.AddUint64(&l.stats.dropped, 1)
+			_ = c.Close()
+		default:
+			return
+		}
+	}
+}
+
+// MuxAddr 为 Match 返回的监听器的地址, 在根监听器地址的基础上携带描述性的名称
+type MuxAddr struct {
+	Root net.Addr
+	Name string
+}
+
+func (a MuxAddr) Network() string {
+	if a.Root == nil {
+		return "mux"
+	}
+	return a.Root.Network()
+}
+
+// String 返回 "name@host:port" 形式的地址, 未设置名称时与根监听器地址相同
+func (a MuxAddr) String() string {
+	switch {
+	case a.Root == nil:
+		return a.Name
+	case a.Name == "":
+		return a.Root.String()
+	default:
+		return a.Name + "@" + a.Root.String()
 	}
 }
 
@@ -156,19 +827,89 @@ func (l muxListener) Accept() (net.Conn, error) {
 type MuxConn struct {
 	net.Conn
 	buf bufferedReader
+	sw  sniffWriter
+	ack *settingsAckFilter // 嗅探阶段发送过 SETTINGS 帧时过滤客户端的 ACK
+
+	remoteAddr net.Addr // PROXY 头中携带的客户端地址
+	proxyErr   error    // 读取 PROXY 头时遇到的错误
+
+	closeOnce sync.Once
+	releases  []func()     // 连接关闭时释放占用的连接名额
+	slot      *muxListener // 占用连接名额的监听器, 溢出转交时随之变化
 }
 
 func newMuxConn(c net.Conn) *MuxConn {
 	return &MuxConn{
 		Conn: c,
 		buf:  bufferedReader{source: c},
+		sw:   sniffWriter{w: c},
 	}
 }
 
 func (m *MuxConn) Read(p []byte) (int, error) {
+	if m.ack != nil {
+		return m.ack.Read(p)
+	}
 	return m.buf.Read(p)
 }
 
+// Close 关闭连接并释放连接占用的连接名额
+func (m *MuxConn) Close() error {
+	m.closeOnce.Do(func() {
+		for _, release := range m.releases {
+			release()
+		}
+		if m.slot != nil {
+			m.slot.release()
+		}
+	})
+	return m.Conn.Close()
+}
+
+// onClose 添加连接关闭时调用的函数
+func (m *MuxConn) onClose(f func()) {
+	m.releases = append(m.releases, f)
+}
+
+// RemoteAddr 返回客户端地址, 连接经过 PROXY protocol 代理时为头中携带的真实客户端地址
+func (m *MuxConn) RemoteAddr() net.Addr {
+	if m.remoteAddr != nil {
+		return m.remoteAddr
+	}
+	return m.Conn.RemoteAddr()
+}
+
+// readProxyHeader 读取并去掉 PROXY 头
+func (m *MuxConn) readProxyHeader() error {
+	// PROXY 头不是匹配器读取的数据, 不受单个匹配器的读取上限限制, 只受嗅探阶段的总字节数限制
+	limit := m.buf.matcherBytes
+	m.buf.matcherBytes = 0
+	addr, n, err := readProxyHeader(m.startSniffing())
+	m.buf.matcherBytes = limit
+	if err != nil {
+		m.proxyErr = err
+		return err
+	}
+	m.buf.discard(n)
+	m.remoteAddr = addr
+	return nil
+}
+
+// clientSilent 判断客户端是否在 window 内未发送任何数据, 读取到的数据会在之后的匹配中重放
+func (m *MuxConn) clientSilent(window time.Duration) bool {
+	if m.buf.buffer.Len() > 0 {
+		return false
+	}
+	_ = m.SetReadDeadline(time.Now().Add(window))
+	var b [1]byte
+	n, err := m.startSniffing().Read(b[:])
+	if n == 0 && isTimeout(err) {
+		m.buf.sniffErr = nil
+		return true
+	}
+	return false
+}
+
 // 开始嗅探
 func (m *MuxConn) startSniffing() io.Reader {
 	m.buf.reset(true)
@@ -178,4 +919,7 @@ func (m *MuxConn) startSniffing() io.Reader {
 // 结束嗅探
 func (m *MuxConn) doneSniffing() {
 	m.buf.reset(false)
+	if m.sw.settingsSent && m.ack == nil {
+		m.ack = newSettingsAckFilter(&m.buf)
+	}
 }
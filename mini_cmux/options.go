@@ -0,0 +1,89 @@
+package mini_cmux
+
+import (
+	"net"
+	"time"
+)
+
+// Option 为创建多路复用器时的配置项
+type Option func(*cMux)
+
+// WithQueueSize 设置各监听器连接队列的默认长度, 默认为 1024,
+// 可以通过 ListenerConfig.QueueSize 为单个监听器单独设置
+func WithQueueSize(n int) Option {
+	return func(m *cMux) {
+		if n > 0 {
+			m.bufLen = n
+		}
+	}
+}
+
+// WithMaxSniffing 设置同时进行匹配的最大连接数, 超出后新连接被直接关闭, n 为 0 时不限制
+func WithMaxSniffing(n int) Option {
+	return func(m *cMux) {
+		m.maxSniffing = n
+	}
+}
+
+// WithMaxConnsPerIP 设置每个来源 IP 的最大连接数, 从接收连接开始计算直到连接关闭,
+// 超出后新连接被直接关闭, n 为 0 时不限制。
+// 来自可信代理的连接按 PROXY 头中的客户端地址计算, 没有 PROXY 头时按代理的地址计算
+func WithMaxConnsPerIP(n int) Option {
+	return func(m *cMux) {
+		m.maxConnsPerIP = n
+	}
+}
+
+// WithMaxListenerConns 设置各监听器的默认最大连接数, 超出后匹配到该监听器的连接被关闭,
+// 可以通过 ListenerConfig.MaxConns 为单个监听器单独设置, n 为 0 时不限制
+func WithMaxListenerConns(n int) Option {
+	return func(m *cMux) {
+		m.maxListenerConns = n
+	}
+}
+
+// WithSniffTimeout 设置整个嗅探阶段的读超时, 匹配成功后清除。
+// 超时仍未匹配的连接会被计数并关闭, d 为 0 时不设置超时
+func WithSniffTimeout(d time.Duration) Option {
+	return func(m *cMux) {
+		m.sniffTimeout = d
+	}
+}
+
+// WithMaxSniffBytes 设置嗅探阶段最多缓存的总字节数, 超出后停止匹配并视为未匹配,
+// n 为 0 时不限制
+func WithMaxSniffBytes(n int) Option {
+	return func(m *cMux) {
+		m.maxSniffBytes = n
+	}
+}
+
+// WithMatcherSniffBytes 设置每个匹配器最多读取的字节数, 超出后该匹配器读取失败,
+// 其余匹配器继续匹配, n 为 0 时不限制
+func WithMatcherSniffBytes(n int) Option {
+	return func(m *cMux) {
+		m.matcherSniffBytes = n
+	}
+}
+
+// NotFoundHandler 处理未被任何匹配器匹配的连接, prefix 为嗅探到的数据,
+// err 为嗅探阶段遇到的错误, 正常读取但未匹配时为 NotMatchErr。
+// c 中已嗅探的数据会被重放, 可以直接向 c 写入协议对应的错误响应。
+// 返回 true 表示连接已被处理, 返回 false 时连接交给兜底监听器或被关闭
+type NotFoundHandler func(c net.Conn, prefix []byte, err error) bool
+
+// WithNotFoundHandler 设置未匹配连接的处理函数, 可用于记录日志或返回错误响应
+func WithNotFoundHandler(h NotFoundHandler) Option {
+	return func(m *cMux) {
+		m.notFound = h
+	}
+}
+
+// WithReadOnlyMatchers 禁止所有匹配器向连接写入数据, 匹配过程不会对连接产生任何副作用。
+// 注意 grpc-go 等客户端在收到服务端的 SETTINGS 帧之前不会发送请求头,
+// 此时 HTTP2 请求头匹配器将无法匹配, 只能使用 HTTP2 preface 等不依赖请求头的匹配器
+func WithReadOnlyMatchers() Option {
+	return func(m *cMux) {
+		m.readOnly = true
+	}
+}
@@ -0,0 +1,251 @@
+package mini_cmux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// 以下匹配器均根据客户端发送的第一段数据识别协议, 不会向连接写入数据。
+// MySQL、SMTP 等由服务端先发送数据的协议在客户端收到服务端的问候前不会发送任何数据,
+// 无法通过嗅探识别, 需要使用 MatchServerFirst 按超时路由
+
+var (
+	sshPrefixes = [][]byte{
+		[]byte("SSH-2.0-"),
+		[]byte("SSH-1.99-"), // 同时兼容 SSH1 的客户端
+	}
+	amqpHeaders = [][]byte{
+		[]byte("AMQP\x00\x00\x09\x01"), // 0-9-1
+		[]byte("AMQP\x01\x01\x00\x0a"), // 0-10
+		[]byte("AMQP\x00\x01\x00\x00"), // 1.0
+		[]byte("AMQP\x02\x01\x00\x00"), // 1.0 TLS
+		[]byte("AMQP\x03\x01\x00\x00"), // 1.0 SASL
+	}
+)
+
+const (
+	pgProtocolV3      = 196608   // StartupMessage 的协议版本 3.0
+	pgCancelRequest   = 80877102 // CancelRequest 的请求码
+	pgSSLRequest      = 80877103 // SSLRequest 的请求码
+	pgGSSENCRequest   = 80877104 // GSSENCRequest 的请求码
+	maxPGStartupLen   = 10000    // 与 PostgreSQL 服务端的 MAX_STARTUP_PACKET_LENGTH 一致
+	maxRedisArrayLen  = 1 << 20  // RESP 数组的最大元素个数
+	maxRedisBulkLen   = 512 << 20
+	maxRedisLineLen   = 10 // RESP 长度行中数字的最大位数
+	maxRedisCmdLen    = 32 // 检查命令名的最大长度
+	mqttPacketConnect = 0x10
+	socks5Version     = 0x05
+)
+
+// SSH 返回一个匹配 SSH 客户端版本标识(RFC 4253 4.2)的匹配器, 如 "SSH-2.0-OpenSSH_8.9"
+func SSH() MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchPrefixes(r, sshPrefixes)
+	}
+}
+
+// PostgreSQL 返回一个匹配 PostgreSQL 客户端第一个消息的匹配器,
+// 包括协议 3.0 的 StartupMessage 以及 SSLRequest、GSSENCRequest 和 CancelRequest
+func PostgreSQL() MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		// 消息长度不超过 maxPGStartupLen, 第一个字节总是 0
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:1]); err != nil || hdr[0] != 0 {
+			return false
+		}
+		if _, err := io.ReadFull(r, hdr[1:]); err != nil {
+			return false
+		}
+		n := binary.BigEndian.Uint32(hdr[:4])
+		switch binary.BigEndian.Uint32(hdr[4:]) {
+		case pgSSLRequest, pgGSSENCRequest:
+			return n == 8
+		case pgCancelRequest:
+			return n == 16
+		case pgProtocolV3:
+		default:
+			return false
+		}
+		if n <= 8 || n > maxPGStartupLen {
+			return false
+		}
+		// 参数为以 \0 结尾的键值对列表, 整个列表以 \0 结尾, 且必须包含 user
+		params := make([]byte, n-8)
+		if _, err := io.ReadFull(r, params); err != nil {
+			return false
+		}
+		if !bytes.HasSuffix(params, []byte{0}) {
+			return false
+		}
+		fields := bytes.Split(params[:len(params)-1], []byte{0})
+		if len(fields)%2 != 1 || len(fields[len(fields)-1]) != 0 {
+			return false
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			if string(fields[i]) == "user" {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Redis 返回一个匹配以 RESP 数组发送命令的 Redis 客户端的匹配器, 如 "*1\r\n$4\r\nPING\r\n"
+func Redis() MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		br := bufio.NewReaderSize(r, 64)
+		n, ok := readRESPLength(br, '*')
+		if !ok || n < 1 || n > maxRedisArrayLen {
+			return false
+		}
+		n, ok = readRESPLength(br, '$')
+		if !ok || n < 1 || n > maxRedisBulkLen {
+			return false
+		}
+		// 命令名应由字母组成, 过长时只检查长度行
+		if n > maxRedisCmdLen {
+			return true
+		}
+		cmd := make([]byte, n+2)
+		if _, err := io.ReadFull(br, cmd); err != nil {
+			return false
+		}
+		if !bytes.HasSuffix(cmd, []byte("\r\n")) {
+			return false
+		}
+		for _, c := range cmd[:n] {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// readRESPLength 读取 "<typ><n>\r\n" 形式的长度行, 逐字节检查以便尽早返回
+func readRESPLength(br *bufio.Reader, typ byte) (int, bool) {
+	if c, err := br.ReadByte(); err != nil || c != typ {
+		return 0, false
+	}
+	n := 0
+	for i := 0; i < maxRedisLineLen; i++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, false
+		}
+		switch {
+		case '0' <= c && c <= '9':
+			n = n*10 + int(c-'0')
+			if n > maxRedisBulkLen {
+				return 0, false
+			}
+		case c == '\r' && i > 0:
+			c, err := br.ReadByte()
+			return n, err == nil && c == '\n'
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// MQTT 返回一个匹配 MQTT CONNECT 报文的匹配器, 支持 3.1、3.1.1 与 5.0 版本
+func MQTT() MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil || b[0] != mqttPacketConnect {
+			return false
+		}
+		// 剩余长度为 1~4 字节的变长整数
+		remain, shift := 0, uint(0)
+		for i := 0; ; i++ {
+			if i == 4 {
+				return false
+			}
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return false
+			}
+			remain |= int(b[0]&0x7f) << shift
+			shift += 7
+			if b[0]&0x80 == 0 {
+				break
+			}
+		}
+
+		var name [2]byte
+		if _, err := io.ReadFull(r, name[:]); err != nil {
+			return false
+		}
+		n := int(binary.BigEndian.Uint16(name[:]))
+		if n != 4 && n != 6 || remain < 2+n+1 {
+			return false
+		}
+		proto := make([]byte, n+1)
+		if _, err := io.ReadFull(r, proto); err != nil {
+			return false
+		}
+		switch string(proto[:n]) {
+		case "MQIsdp":
+			return proto[n] == 3
+		case "MQTT":
+			return proto[n] == 4 || proto[n] == 5
+		}
+		return false
+	}
+}
+
+// AMQP 返回一个匹配 AMQP 协议头的匹配器, 支持 0-9-1、0-10 与 1.0 版本
+func AMQP() MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		return matchPrefixes(r, amqpHeaders)
+	}
+}
+
+// SOCKS5 返回一个匹配 SOCKS5 客户端问候(RFC 1928 3)的匹配器
+func SOCKS5() MatchWriter {
+	return func(w io.Writer, r io.Reader) bool {
+		var hdr [2]byte
+		if _, err := io.ReadFull(r, hdr[:1]); err != nil || hdr[0] != socks5Version {
+			return false
+		}
+		if _, err := io.ReadFull(r, hdr[1:]); err != nil || hdr[1] == 0 {
+			return false
+		}
+		methods := make([]byte, hdr[1])
+		_, err := io.ReadFull(r, methods)
+		return err == nil
+	}
+}
+
+// matchPrefixes 逐步读取数据, 直到与 prefixes 中的某一项完全相同或已不可能相同
+func matchPrefixes(r io.Reader, prefixes [][]byte) bool {
+	max := 0
+	for _, p := range prefixes {
+		if len(p) > max {
+			max = len(p)
+		}
+	}
+	buf := make([]byte, max)
+	n := 0
+	for {
+		possible := false
+		for _, p := range prefixes {
+			if n >= len(p) && bytes.Equal(buf[:len(p)], p) {
+				return true
+			}
+			if n < len(p) && bytes.HasPrefix(p, buf[:n]) {
+				possible = true
+			}
+		}
+		if !possible {
+			return false
+		}
+		rn, err := r.Read(buf[n:])
+		n += rn
+		if err != nil && rn == 0 {
+			return false
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package mini_cmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ProxyHeaderErr = errors.New("invalid proxy protocol header")
+
+var (
+	proxyV1Sig = []byte("PROXY ")
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	maxProxyV1Len    = 107 // v1 头的最大长度, 包含结尾的 CRLF
+	proxyV2HeaderLen = 16  // v2 头的固定部分长度
+)
+
+// WithProxyProtocol 开启 PROXY protocol v1/v2 支持, 来自 trusted 网段的连接在匹配前
+// 解析并去掉 PROXY 头, MuxConn.RemoteAddr() 返回头中携带的客户端地址。
+// PROXY 头是可选的, 不以 PROXY 头开头的连接按原样匹配; 头格式错误时连接按 ProxyHeaderErr 未匹配处理。
+// 来自其他来源的连接不解析 PROXY 头, 未传入 trusted 时不信任任何来源,
+// 否则任意客户端都可以通过 PROXY 头伪造自己的地址
+func WithProxyProtocol(trusted ...*net.IPNet) Option {
+	return func(m *cMux) {
+		m.proxyProtocol = true
+		m.trustedProxies = trusted
+	}
+}
+
+// readsProxyHeader 判断是否需要读取来自 addr 的连接的 PROXY 头
+func (m *cMux) readsProxyHeader(addr net.Addr) bool {
+	return m.proxyProtocol && m.isTrustedProxy(addr)
+}
+
+// isTrustedProxy 判断连接是否来自可信的代理
+func (m *cMux) isTrustedProxy(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	for _, n := range m.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader 从连接数据中读取 PROXY 头, 返回头中的客户端地址与头的长度。
+// 数据不以 PROXY 头开头时返回 (nil, 0, nil), 头中未携带地址(UNKNOWN / LOCAL)时地址为 nil
+func readProxyHeader(r io.Reader) (net.Addr, int, error) {
+	var b []byte
+	p := make([]byte, 256)
+	for {
+		if !maybePrefix(b, proxyV1Sig) && !maybePrefix(b, proxyV2Sig) {
+			return nil, 0, nil
+		}
+		if bytes.HasPrefix(b, proxyV1Sig) {
+			if i := bytes.Index(b, []byte("\r\n")); i >= 0 {
+				if i+2 > maxProxyV1Len {
+					return nil, 0, ProxyHeaderErr
+				}
+				addr, err := parseProxyV1(string(b[:i]))
+				return addr, i + 2, err
+			}
+			if len(b) >= maxProxyV1Len {
+				return nil, 0, ProxyHeaderErr
+			}
+		} else if bytes.HasPrefix(b, proxyV2Sig) && len(b) >= proxyV2HeaderLen {
+			n := proxyV2HeaderLen + int(binary.BigEndian.Uint16(b[14:16]))
+			if len(b) >= n {
+				addr, err := parseProxyV2(b[:n])
+				return addr, n, err
+			}
+		}
+
+		n, err := r.Read(p)
+		b = append(b, p[:n]...)
+		if err != nil && n == 0 {
+			return nil, 0, err
+		}
+	}
+}
+
+// maybePrefix 判断 b 是否可能是以 sig 开头的数据
+func maybePrefix(b, sig []byte) bool {
+	if len(b) < len(sig) {
+		return bytes.HasPrefix(sig, b)
+	}
+	return bytes.HasPrefix(b, sig)
+}
+
+// parseProxyV1 解析不含 CRLF 的 v1 头, 如 "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443"
+func parseProxyV1(line string) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 {
+		return nil, ProxyHeaderErr
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ProxyHeaderErr
+	}
+	if len(fields) != 6 {
+		return nil, ProxyHeaderErr
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || net.ParseIP(fields[3]) == nil {
+		return nil, ProxyHeaderErr
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ProxyHeaderErr
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, ProxyHeaderErr
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyV2 解析完整的 v2 头, 地址之后的 TLV 字段被忽略
+func parseProxyV2(b []byte) (net.Addr, error) {
+	if b[12]>>4 != 2 {
+		return nil, ProxyHeaderErr
+	}
+	switch b[12] & 0x0f {
+	case 0x0: // LOCAL, 如代理自身的健康检查
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ProxyHeaderErr
+	}
+
+	addrs := b[proxyV2HeaderLen:]
+	var ip net.IP
+	var port int
+	switch b[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(addrs) < 12 {
+			return nil, ProxyHeaderErr
+		}
+		ip = net.IP(append([]byte(nil), addrs[:4]...))
+		port = int(binary.BigEndian.Uint16(addrs[8:10]))
+	case 0x2: // AF_INET6
+		if len(addrs) < 36 {
+			return nil, ProxyHeaderErr
+		}
+		ip = net.IP(append([]byte(nil), addrs[:16]...))
+		port = int(binary.BigEndian.Uint16(addrs[32:34]))
+	default: // AF_UNSPEC 与 AF_UNIX 不携带可用的客户端地址
+		return nil, nil
+	}
+	switch b[13] & 0x0f {
+	case 0x1: // STREAM
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	case 0x2: // DGRAM
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return nil, ProxyHeaderErr
+}
@@ -0,0 +1,169 @@
+package mini_cmux
+
+import (
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit 为按来源 IP 限制接收连接速率的配置, 使用令牌桶算法,
+// 在接收连接后、匹配之前进行检查, 保护开销最大的嗅探阶段
+type RateLimit struct {
+	Rate  float64 // 每个来源每秒允许的连接数
+	Burst int     // 令牌桶容量, 即允许的突发连接数, 为 0 时为 Rate 向上取整
+
+	// 聚合来源地址的前缀长度, 同一网段的地址共用一个令牌桶,
+	// 为 0 时 IPv4 为 32, IPv6 为 64 (通常分配给单个用户的网段)
+	IPv4Prefix int
+	IPv6Prefix int
+
+	Delay    bool          // 超出速率时延迟到有可用令牌再开始匹配, 为 false 时直接关闭连接
+	MaxDelay time.Duration // Delay 时的最长延迟, 需要等待更久的连接被关闭, 为 0 时为 1s
+}
+
+// WithRateLimit 按来源 IP 限制接收连接的速率。
+// 在匹配之前进行, 来自可信代理的连接在读取 PROXY 头后按头中的客户端地址计算,
+// 延迟中的连接计入正在匹配的连接数, 受 WithMaxSniffing 的限制
+func WithRateLimit(r RateLimit) Option {
+	return func(m *cMux) {
+		if r.Rate > 0 {
+			m.rateLimiter = newRateLimiter(r)
+		}
+	}
+}
+
+const (
+	// minSweepSize 为清理空闲令牌桶的最小桶数
+	minSweepSize = 1024
+	// defaultMaxDelay 为默认的最长延迟, 限制单个来源延迟中的连接数, 避免其占满匹配名额
+	defaultMaxDelay = time.Second
+)
+
+type tokenBucket struct {
+	tokens float64   // 可用令牌数, 延迟的连接会预支令牌, 此时为负数
+	last   time.Time // 上次补充令牌的时间
+}
+
+type rateLimiter struct {
+	RateLimit
+	v4Mask, v6Mask net.IPMask
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	nextSweep int // 桶数达到该值时清理已补满的令牌桶
+}
+
+func newRateLimiter(r RateLimit) *rateLimiter {
+	if r.Burst <= 0 {
+		r.Burst = int(math.Ceil(r.Rate))
+	}
+	if r.Delay && r.MaxDelay <= 0 {
+		r.MaxDelay = defaultMaxDelay
+	}
+	if r.IPv4Prefix <= 0 || r.IPv4Prefix > 32 {
+		r.IPv4Prefix = 32
+	}
+	if r.IPv6Prefix <= 0 || r.IPv6Prefix > 128 {
+		r.IPv6Prefix = 64
+	}
+	return &rateLimiter{
+		RateLimit: r,
+		v4Mask:    net.CIDRMask(r.IPv4Prefix, 32),
+		v6Mask:    net.CIDRMask(r.IPv6Prefix, 128),
+		buckets:   make(map[string]*tokenBucket),
+		nextSweep: minSweepSize,
+	}
+}
+
+// reserveRate 为来源地址取一个令牌, 超出速率且不能延迟时返回 false
+func (m *cMux) reserveRate(addr net.Addr) (time.Duration, bool) {
+	wait, ok := m.rateLimiter.reserve(addr, time.Now())
+	if !ok {
+		atomic.AddUint64(&m.stats.rateLimited, 1)
+		return 0, false
+	}
+	if wait > 0 {
+		atomic.AddUint64(&m.stats.rateDelayed, 1)
+	}
+	return wait, true
+}
+
+// waitRate 等待可用令牌, 多路复用器关闭时返回 false
+func waitRate(wait time.Duration, donec <-chan struct{}) bool {
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-donec:
+		return false
+	}
+}
+
+// key 返回来源地址所属网段, 无法解析的地址按原样计算
+func (r *rateLimiter) key(addr net.Addr) string {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(r.v4Mask).String()
+	}
+	return ip.Mask(r.v6Mask).String()
+}
+
+// reserve 为来源地址取一个令牌, 返回开始匹配前需要等待的时间, 连接需要被关闭时 ok 为 false
+func (r *rateLimiter) reserve(addr net.Addr, now time.Time) (wait time.Duration, ok bool) {
+	k := r.key(addr)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := r.buckets[k]
+	if b == nil {
+		if len(r.buckets) >= r.nextSweep {
+			r.sweep(now)
+		}
+		b = &tokenBucket{tokens: float64(r.Burst), last: now}
+		r.buckets[k] = b
+	}
+	b.refill(r, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if !r.Delay {
+		return 0, false
+	}
+	wait = time.Duration((1 - b.tokens) / r.Rate * float64(time.Second))
+	if wait > r.MaxDelay {
+		return 0, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// sweep 删除已补满的令牌桶, 补满的桶与新建的桶等价
+func (r *rateLimiter) sweep(now time.Time) {
+	for k, b := range r.buckets {
+		if b.refill(r, now); b.tokens >= float64(r.Burst) {
+			delete(r.buckets, k)
+		}
+	}
+	r.nextSweep = 2 * len(r.buckets)
+	if r.nextSweep < minSweepSize {
+		r.nextSweep = minSweepSize
+	}
+}
+
+func (b *tokenBucket) refill(r *rateLimiter, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(r.Burst), b.tokens+elapsed.Seconds()*r.Rate)
+		b.last = now
+	}
+}
@@ -0,0 +1,142 @@
+package mini_cmux
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// sniffLatencyBuckets 为嗅探耗时直方图的桶上界, 单位为秒
+var sniffLatencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// Stats 为多路复用器的统计数据
+type Stats struct {
+	SniffTimeouts  uint64 // 嗅探超时的连接数
+	SniffOverflows uint64 // 嗅探数据超出上限的连接数
+	SniffErrors    uint64 // 嗅探阶段读取出错的连接数, 包括超时与超出上限
+	Unmatched      uint64 // 未被任何匹配器匹配的连接数
+	Sniffing       int64  // 正在进行匹配的连接数, 包括等待速率限制的连接
+	SniffLimited   uint64 // 因同时匹配的连接数达到上限而被关闭的连接数
+	IPLimited      uint64 // 因来源 IP 的连接数达到上限而被关闭的连接数
+	RateLimited    uint64 // 因来源 IP 的连接速率超出限制而被关闭的连接数
+	RateDelayed    uint64 // 因来源 IP 的连接速率超出限制而被延迟匹配的连接数
+
+	SniffLatency Histogram       // 从接收连接到得出匹配结果的耗时
+	Listeners    []ListenerStats // 各监听器的统计数据, 按注册顺序排列
+}
+
+// ListenerStats 为单个监听器的统计数据
+type ListenerStats struct {
+	Name       string // 监听器名称, 未设置名称时为注册序号
+	Matched    uint64 // 被匹配器匹配的连接数
+	Dispatched uint64 // 放入连接队列的连接数
+	Dropped    uint64 // 因监听器或多路复用器关闭而被关闭的连接数
+	QueueLen   int    // 连接队列中等待 Accept 的连接数
+	Active     int64  // 当前连接数, 只在设置了 MaxConns 时统计
+	Limited    uint64 // 因连接数达到 MaxConns 而被关闭的连接数
+
+	// 连接队列已满时各溢出策略的处理结果
+	Rejected uint64 // 被直接关闭的连接数, 包括 OverflowSpill 时 Fallback 无法接收的连接
+	TimedOut uint64 // OverflowBlock 等待超时后被关闭的连接数
+	Spilled  uint64 // 交给 Fallback 监听器的连接数
+}
+
+// Histogram 为累积直方图, Counts[i] 为不超过 Buckets[i] 的观测数
+type Histogram struct {
+	Buckets []float64
+	Counts  []uint64
+	Sum     float64 // 所有观测值之和, 单位为秒
+	Count   uint64
+}
+
+type stats struct {
+	sniffTimeouts  uint64
+	sniffOverflows uint64
+	sniffErrors    uint64
+	unmatched      uint64
+	sniffing       int64
+	sniffLimited   uint64
+	ipLimited      uint64
+	rateLimited    uint64
+	rateDelayed    uint64
+	sniffLatency   histogram
+}
+
+type listenerStats struct {
+	matched    uint64
+	dispatched uint64
+	dropped    uint64
+	rejected   uint64
+	timedOut   uint64
+	spilled    uint64
+	limited    uint64
+	active     int64
+}
+
+type histogram struct {
+	sum    uint64     // 纳秒
+	counts [11]uint64 // 与 sniffLatencyBuckets 对应, 最后一个为 +Inf
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(sniffLatencyBuckets) && d.Seconds() > sniffLatencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Buckets: sniffLatencyBuckets,
+		Counts:  make([]uint64, len(sniffLatencyBuckets)),
+		Sum:     time.Duration(atomic.LoadUint64(&h.sum)).Seconds(),
+	}
+	var cum uint64
+	for i := range s.Counts {
+		cum += atomic.LoadUint64(&h.counts[i])
+		s.Counts[i] = cum
+	}
+	s.Count = cum + atomic.LoadUint64(&h.counts[len(s.Counts)])
+	return s
+}
+
+func (m *cMux) Stats() Stats {
+	s := Stats{
+		SniffTimeouts:  atomic.LoadUint64(&m.stats.sniffTimeouts),
+		SniffOverflows: atomic.LoadUint64(&m.stats.sniffOverflows),
+		SniffErrors:    atomic.LoadUint64(&m.stats.sniffErrors),
+		Unmatched:      atomic.LoadUint64(&m.stats.unmatched),
+		Sniffing:       atomic.LoadInt64(&m.stats.sniffing),
+		SniffLimited:   atomic.LoadUint64(&m.stats.sniffLimited),
+		IPLimited:      atomic.LoadUint64(&m.stats.ipLimited),
+		RateLimited:    atomic.LoadUint64(&m.stats.rateLimited),
+		RateDelayed:    atomic.LoadUint64(&m.stats.rateDelayed),
+		SniffLatency:   m.stats.sniffLatency.snapshot(),
+	}
+	for _, sl := range m.matchers() {
+		s.Listeners = append(s.Listeners, sl.l.statsSnapshot())
+	}
+	return s
+}
+
+func (l *muxListener) statsSnapshot() ListenerStats {
+	return ListenerStats{
+		Name:       l.label,
+		Matched:    atomic.LoadUint64(&l.stats.matched),
+		Dispatched: atomic.LoadUint64(&l.stats.dispatched),
+		Dropped:    atomic.LoadUint64(&l.stats.dropped),
+		QueueLen:   len(l.connc),
+		Active:     atomic.LoadInt64(&l.stats.active),
+		Limited:    atomic.LoadUint64(&l.stats.limited),
+		Rejected:   atomic.LoadUint64(&l.stats.rejected),
+		TimedOut:   atomic.LoadUint64(&l.stats.timedOut),
+		Spilled:    atomic.LoadUint64(&l.stats.spilled),
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,224 @@
+package mini_cmux
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	recordHeaderLen          = 5
+	maxRecordLen             = 16384 + 2048 // TLSCiphertext 的最大长度
+	maxClientHelloLen        = 1 << 16      // 嗅探时允许的最大 ClientHello 长度
+
+	extensionServerName        = 0
+	extensionALPN              = 16
+	extensionSupportedVersions = 43
+)
+
+var errNotClientHello = errors.New("not a tls client hello")
+
+// ClientHello 为嗅探到的 TLS ClientHello 中与路由相关的字段
+type ClientHello struct {
+	Version           uint16   // legacy_version 字段
+	ServerName        string   // SNI 扩展中的主机名
+	ALPN              []string // ALPN 扩展中的协议列表
+	SupportedVersions []uint16 // supported_versions 扩展中的版本列表
+	CipherSuites      []uint16
+}
+
+// MaxVersion 返回客户端支持的最高 TLS 版本
+func (h *ClientHello) MaxVersion() uint16 {
+	max := h.Version
+	for _, v := range h.SupportedVersions {
+		// 跳过 GREASE 值
+		if v&0x0f0f == 0x0a0a {
+			continue
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// readClientHello 从嗅探数据中读取并解析 ClientHello, 可跨越多个 TLS 记录
+func readClientHello(r io.Reader) (*ClientHello, error) {
+	var msg []byte
+	msgLen := -1
+	for msgLen < 0 || len(msg) < msgLen {
+		var hdr [recordHeaderLen]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		// 只接受 SSL3.0 及以上版本的握手记录
+		if hdr[0] != recordTypeHandshake || hdr[1] != 3 {
+			return nil, errNotClientHello
+		}
+		n := int(binary.BigEndian.Uint16(hdr[3:]))
+		if n == 0 || n > maxRecordLen {
+			return nil, errNotClientHello
+		}
+		fragment := make([]byte, n)
+		if _, err := io.ReadFull(r, fragment); err != nil {
+			return nil, err
+		}
+		msg = append(msg, fragment...)
+
+		if msgLen < 0 && len(msg) >= 4 {
+			if msg[0] != handshakeTypeClientHello {
+				return nil, errNotClientHello
+			}
+			msgLen = 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if msgLen > maxClientHelloLen {
+				return nil, errNotClientHello
+			}
+		}
+	}
+	return parseClientHello(msg[4:msgLen])
+}
+
+// parseClientHello 解析 ClientHello 消息体(不含握手消息头)
+func parseClientHello(b []byte) (*ClientHello, error) {
+	s := cryptoString(b)
+	hello := &ClientHello{}
+
+	var random, sessionID, ciphers, compression []byte
+	if !s.readUint16(&hello.Version) ||
+		!s.readBytes(32, &random) ||
+		!s.readUint8LengthPrefixed(&sessionID) ||
+		!s.readUint16LengthPrefixed(&ciphers) ||
+		!s.readUint8LengthPrefixed(&compression) {
+		return nil, errNotClientHello
+	}
+	cs := cryptoString(ciphers)
+	for !cs.empty() {
+		var suite uint16
+		if !cs.readUint16(&suite) {
+			return nil, errNotClientHello
+		}
+		hello.CipherSuites = append(hello.CipherSuites, suite)
+	}
+
+	// 扩展字段是可选的
+	if s.empty() {
+		return hello, nil
+	}
+	var extensions cryptoString
+	if !s.readUint16LengthPrefixed((*[]byte)(&extensions)) || !s.empty() {
+		return nil, errNotClientHello
+	}
+	for !extensions.empty() {
+		var typ uint16
+		var data cryptoString
+		if !extensions.readUint16(&typ) || !extensions.readUint16LengthPrefixed((*[]byte)(&data)) {
+			return nil, errNotClientHello
+		}
+		switch typ {
+		case extensionServerName:
+			var names cryptoString
+			if !data.readUint16LengthPrefixed((*[]byte)(&names)) {
+				return nil, errNotClientHello
+			}
+			for !names.empty() {
+				var nameType uint8
+				var name []byte
+				if !names.readUint8(&nameType) || !names.readUint16LengthPrefixed(&name) {
+					return nil, errNotClientHello
+				}
+				// 0 为 host_name
+				if nameType == 0 {
+					hello.ServerName = string(name)
+				}
+			}
+		case extensionALPN:
+			var protos cryptoString
+			if !data.readUint16LengthPrefixed((*[]byte)(&protos)) {
+				return nil, errNotClientHello
+			}
+			for !protos.empty() {
+				var proto []byte
+				if !protos.readUint8LengthPrefixed(&proto) || len(proto) == 0 {
+					return nil, errNotClientHello
+				}
+				hello.ALPN = append(hello.ALPN, string(proto))
+			}
+		case extensionSupportedVersions:
+			var versions cryptoString
+			if !data.readUint8LengthPrefixed((*[]byte)(&versions)) {
+				return nil, errNotClientHello
+			}
+			for !versions.empty() {
+				var v uint16
+				if !versions.readUint16(&v) {
+					return nil, errNotClientHello
+				}
+				hello.SupportedVersions = append(hello.SupportedVersions, v)
+			}
+		}
+	}
+	return hello, nil
+}
+
+// tlsListener 对匹配到的 TLS 连接进行服务端握手, 作为二次匹配多路复用器的根监听器
+type tlsListener struct {
+	*muxListener
+	config *tls.Config
+}
+
+func (l tlsListener) Accept() (net.Conn, error) {
+	c, err := l.muxListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// 握手在第一次读取时进行, 即发生在二次匹配的嗅探阶段
+	return tls.Server(c, l.config), nil
+}
+
+// cryptoString 是按 TLS 编码规则顺序读取字节的辅助类型
+type cryptoString []byte
+
+func (s *cryptoString) empty() bool {
+	return len(*s) == 0
+}
+
+func (s *cryptoString) readBytes(n int, out *[]byte) bool {
+	if len(*s) < n {
+		return false
+	}
+	*out = (*s)[:n]
+	*s = (*s)[n:]
+	return true
+}
+
+func (s *cryptoString) readUint8(out *uint8) bool {
+	var b []byte
+	if !s.readBytes(1, &b) {
+		return false
+	}
+	*out = b[0]
+	return true
+}
+
+func (s *cryptoString) readUint16(out *uint16) bool {
+	var b []byte
+	if !s.readBytes(2, &b) {
+		return false
+	}
+	*out = binary.BigEndian.Uint16(b)
+	return true
+}
+
+func (s *cryptoString) readUint8LengthPrefixed(out *[]byte) bool {
+	var n uint8
+	return s.readUint8(&n) && s.readBytes(int(n), out)
+}
+
+func (s *cryptoString) readUint16LengthPrefixed(out *[]byte) bool {
+	var n uint16
+	return s.readUint16(&n) && s.readBytes(int(n), out)
+}
@@ -0,0 +1,293 @@
+package proxyServer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ljhhhhhh1224/mini_cmux/logging"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5NoAuth       = 0x00
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5Succeeded        = 0x00
+	socks5NotAllowed       = 0x02
+	socks5HostUnreachable  = 0x04
+	socks5CmdNotSupported  = 0x07
+	socks5AtypNotSupported = 0x08
+)
+
+const (
+	defaultDialTimeout = 10 * time.Second
+	handshakeTimeout   = 10 * time.Second // 完成代理握手的超时时间
+
+	connectionEstablishedResp = "HTTP/1.1 200 Connection Established\r\n\r\n"
+)
+
+var errSocks5Handshake = errors.New("invalid socks5 handshake")
+
+// Server 为可以挂载在 mini_cmux 监听器上的正向代理, 同时支持 SOCKS5 与 HTTP CONNECT,
+// 通常与 mini_cmux.SOCKS5()、mini_cmux.HTTPConnect() 匹配器一起使用
+type Server struct {
+	AllowedClients []*net.IPNet // 允许使用代理的客户端网段, 为空时拒绝所有客户端
+	// AllowedHosts 为允许访问的目标主机, 支持主机名、"*.example.com" 通配符、
+	// CIDR 以及表示任意目标的 "*", 为空时拒绝所有目标
+	AllowedHosts []string
+	DialTimeout  time.Duration // 连接目标的超时时间, 为 0 时使用 10s
+
+	// Dial 用于连接目标, 为空时使用 net.Dialer
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+// Serve 接收 l 上的连接并进行代理, 直到 l 返回错误
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	if !s.clientAllowed(c.RemoteAddr()) {
+		logging.Warn("Proxy client not allowed : ", c.RemoteAddr())
+		_ = c.Close()
+		return
+	}
+
+	_ = c.SetDeadline(time.Now().Add(handshakeTimeout))
+	br := bufio.NewReader(c)
+	b, err := br.Peek(1)
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+	var target net.Conn
+	if b[0] == socks5Version {
+		target, err = s.socks5Handshake(c, br)
+	} else {
+		target, err = s.connectHandshake(c, br)
+	}
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	logging.Info("Proxy ", c.RemoteAddr(), " -> ", target.RemoteAddr())
+	relay(c, br, target)
+}
+
+// socks5Handshake 完成 SOCKS5 的方法协商与 CONNECT 请求, 返回已连接的目标
+func (s *Server) socks5Handshake(c net.Conn, br *bufio.Reader) (net.Conn, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(br, hdr[:2]); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return nil, err
+	}
+	// 只支持无认证方式, 访问控制由客户端网段与目标主机白名单完成
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil || method == socks5NoAcceptable {
+		return nil, errSocks5Handshake
+	}
+
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socks5Version {
+		return nil, errSocks5Handshake
+	}
+	var host string
+	switch hdr[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(br, n[:]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		_ = socks5Reply(c, socks5AtypNotSupported, nil)
+		return nil, errSocks5Handshake
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(br, port[:]); err != nil {
+		return nil, err
+	}
+	if hdr[1] != socks5CmdConnect {
+		_ = socks5Reply(c, socks5CmdNotSupported, nil)
+		return nil, errSocks5Handshake
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	if !s.hostAllowed(host) {
+		logging.Warn("Proxy target not allowed : ", c.RemoteAddr(), " -> ", addr)
+		_ = socks5Reply(c, socks5NotAllowed, nil)
+		return nil, errSocks5Handshake
+	}
+	target, err := s.dial(addr)
+	if err != nil {
+		_ = socks5Reply(c, socks5HostUnreachable, nil)
+		return nil, err
+	}
+	if err := socks5Reply(c, socks5Succeeded, target.LocalAddr()); err != nil {
+		_ = target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+// socks5Reply 发送 SOCKS5 应答, bound 为代理连接目标时使用的本地地址
+func socks5Reply(w io.Writer, rep byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if a, ok := bound.(*net.TCPAddr); ok {
+		ip, port = a.IP, a.Port
+	}
+	atyp := byte(socks5AtypIPv4)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		atyp = socks5AtypIPv6
+	}
+	b := append([]byte{socks5Version, rep, 0x00, atyp}, ip...)
+	b = append(b, byte(port>>8), byte(port))
+	_, err := w.Write(b)
+	return err
+}
+
+// connectHandshake 处理 HTTP CONNECT 请求, 返回已连接的目标
+func (s *Server) connectHandshake(c net.Conn, br *bufio.Reader) (net.Conn, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != http.MethodConnect {
+		return nil, httpError(c, http.StatusMethodNotAllowed)
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		return nil, httpError(c, http.StatusBadRequest)
+	}
+	if !s.hostAllowed(host) {
+		logging.Warn("Proxy target not allowed : ", c.RemoteAddr(), " -> ", req.Host)
+		return nil, httpError(c, http.StatusForbidden)
+	}
+	target, err := s.dial(req.Host)
+	if err != nil {
+		_ = httpError(c, http.StatusBadGateway)
+		return nil, err
+	}
+	if _, err := io.WriteString(c, connectionEstablishedResp); err != nil {
+		_ = target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+// httpError 向客户端返回错误状态码并返回对应的错误
+func httpError(w io.Writer, code int) error {
+	status := strconv.Itoa(code) + " " + http.StatusText(code)
+	_, _ = io.WriteString(w, "HTTP/1.1 "+status+"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	return errors.New(status)
+}
+
+func (s *Server) dial(addr string) (net.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial("tcp", addr)
+	}
+	timeout := s.DialTimeout
+	if timeout == 0 {
+		timeout = defaultDialTimeout
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func (s *Server) clientAllowed(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range s.AllowedClients {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) hostAllowed(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip := net.ParseIP(host)
+	for _, pattern := range s.AllowedHosts {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == "*":
+			return true
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		case strings.Contains(pattern, "/"):
+			if _, n, err := net.ParseCIDR(pattern); err == nil && ip != nil && n.Contains(ip) {
+				return true
+			}
+		case host == pattern:
+			return true
+		}
+	}
+	return false
+}
+
+// relay 在客户端与目标之间双向转发数据, 任意一方结束后关闭两个连接
+func relay(c net.Conn, r io.Reader, target net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(target, r)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(c, target)
+		done <- struct{}{}
+	}()
+	<-done
+	_ = c.Close()
+	_ = target.Close()
+	<-done
+}
@@ -0,0 +1,154 @@
+package proxyServer
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mini_cmux2 "github.com/ljhhhhhh1224/mini_cmux/mini_cmux"
+
+	"golang.org/x/net/proxy"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// startMux 在同一端口上启动代理与普通 HTTP 服务
+func startMux(s *Server) net.Listener {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	m := mini_cmux2.New(l)
+	proxyL := m.Match(mini_cmux2.SOCKS5(), mini_cmux2.HTTPConnect())
+	httpL := m.Match(mini_cmux2.HTTP1Fast())
+	go s.Serve(proxyL)
+	go http.Serve(httpL, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "service")
+	}))
+	go m.Serve()
+	return l
+}
+
+// connect 通过 HTTP CONNECT 隧道发送 GET 请求, 返回 CONNECT 的状态码与隧道内的响应
+func connect(proxyAddr, target string) (int, string, error) {
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return 0, "", err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return 0, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, "", nil
+	}
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return http.StatusOK, string(b), err
+}
+
+// socks5Get 通过 SOCKS5 代理发送 GET 请求
+func socks5Get(proxyAddr, url string) (string, error) {
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
+	if err != nil {
+		return "", err
+	}
+	client := http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{Dial: dialer.Dial, DisableKeepAlives: true},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "target")
+	}))
+	defer target.Close()
+	targetAddr := target.Listener.Addr().String()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+
+	Convey("Test forward proxy", t, func() {
+		l := startMux(&Server{AllowedClients: []*net.IPNet{loopback}, AllowedHosts: []string{"127.0.0.1"}})
+		defer l.Close()
+
+		code, body, err := connect(l.Addr().String(), targetAddr)
+		So(err, ShouldBeNil)
+		So(code, ShouldEqual, http.StatusOK)
+		So(body, ShouldEqual, "target")
+
+		body, err = socks5Get(l.Addr().String(), target.URL)
+		So(err, ShouldBeNil)
+		So(body, ShouldEqual, "target")
+
+		// 同一端口上的普通 HTTP 请求不受影响
+		resp, err := http.Get("http://" + l.Addr().String())
+		So(err, ShouldBeNil)
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		So(string(b), ShouldEqual, "service")
+	})
+
+	Convey("Test forward proxy target allowlist", t, func() {
+		l := startMux(&Server{AllowedClients: []*net.IPNet{loopback}, AllowedHosts: []string{"*.example.com"}})
+		defer l.Close()
+
+		code, _, err := connect(l.Addr().String(), targetAddr)
+		So(err, ShouldBeNil)
+		So(code, ShouldEqual, http.StatusForbidden)
+
+		_, err = socks5Get(l.Addr().String(), target.URL)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Test forward proxy client allowlist", t, func() {
+		_, private, _ := net.ParseCIDR("10.0.0.0/8")
+		l := startMux(&Server{AllowedClients: []*net.IPNet{private}, AllowedHosts: []string{"*"}})
+		defer l.Close()
+
+		_, _, err := connect(l.Addr().String(), targetAddr)
+		So(err, ShouldNotBeNil)
+		_, err = socks5Get(l.Addr().String(), target.URL)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestHostAllowed(t *testing.T) {
+	s := &Server{AllowedHosts: []string{"api.example.com", "*.internal", "10.0.0.0/8"}}
+	Convey("Test target host allowlist", t, func() {
+		cases := []struct {
+			host string
+			want bool
+		}{
+			{"api.example.com", true},
+			{"API.Example.com.", true},
+			{"www.example.com", false},
+			{"db.internal", true},
+			{"a.b.internal", true},
+			{"internal", false},
+			{"10.1.2.3", true},
+			{"192.168.1.1", false},
+		}
+		for _, c := range cases {
+			So(s.hostAllowed(c.host), ShouldEqual, c.want)
+		}
+		So((&Server{}).hostAllowed("api.example.com"), ShouldBeFalse)
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/ljhhhhhh1224/mini_cmux/utils"
@@ -13,6 +14,7 @@ import (
 	"github.com/ljhhhhhh1224/mini_cmux/grpcServer"
 	"github.com/ljhhhhhh1224/mini_cmux/logging"
 	hello_grpc "github.com/ljhhhhhh1224/mini_cmux/pb"
+	"github.com/ljhhhhhh1224/mini_cmux/proxyServer"
 	"github.com/ljhhhhhh1224/mini_cmux/syscallOperate"
 
 	"google.golang.org/grpc"
@@ -24,11 +26,75 @@ func main() {
 		logging.Error(err)
 	}
 
-	m := mini_cmux2.New(l)
+	var opts []mini_cmux2.Option
+	if timeout := utils.Config().Server.SniffTimeout; timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		opts = append(opts, mini_cmux2.WithSniffTimeout(d))
+	}
+	if utils.Config().Server.ProxyProtocol {
+		// 未设置可信网段时多路复用器不解析任何 PROXY 头, 视为配置错误
+		if len(utils.Config().Server.TrustedProxies) == 0 {
+			logging.Fatal("ProxyProtocol requires TrustedProxies")
+		}
+		var trusted []*net.IPNet
+		for _, cidr := range utils.Config().Server.TrustedProxies {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				logging.Fatal(err)
+			}
+			trusted = append(trusted, n)
+		}
+		opts = append(opts, mini_cmux2.WithProxyProtocol(trusted...))
+	}
+	var maxDelay time.Duration
+	if d := utils.Config().Server.RateMaxDelay; d != "" {
+		if maxDelay, err = time.ParseDuration(d); err != nil {
+			logging.Fatal(err)
+		}
+	}
+	// 并发连接数限制, 为 0 时不限制
+	opts = append(opts,
+		mini_cmux2.WithMaxSniffing(utils.Config().Server.MaxSniffing),
+		mini_cmux2.WithMaxConnsPerIP(utils.Config().Server.MaxConnsPerIP),
+		mini_cmux2.WithMaxListenerConns(utils.Config().Server.MaxListenerConns),
+		mini_cmux2.WithRateLimit(mini_cmux2.RateLimit{
+			Rate:     utils.Config().Server.RateLimit,
+			Burst:    utils.Config().Server.RateBurst,
+			Delay:    utils.Config().Server.RateLimitDelay,
+			MaxDelay: maxDelay,
+		}),
+	)
+	// 记录未匹配连接的来源与嗅探到的前缀
+	opts = append(opts, mini_cmux2.WithNotFoundHandler(func(c net.Conn, prefix []byte, err error) bool {
+		if len(prefix) > 64 {
+			prefix = prefix[:64]
+		}
+		logging.Warn("Unmatched connection from ", c.RemoteAddr(), " : ", err, " ", strconv.Quote(string(prefix)))
+		return false
+	}))
+	m := mini_cmux2.New(l, opts...)
 
-	//匹配
-	grpcL := m.Match(mini_cmux2.HTTP2HeaderField("content-type", "application/grpc"))
-	httpL := m.Match(mini_cmux2.HTTP1HeaderField("content-type", "application/json"))
+	//匹配, 非 grpc 的 HTTP2 连接(h2c)与 HTTP 1 连接一起交给 gin
+	//WebSocket 连接使用单独的监听器, 同样由 gin 处理
+	//监听器名称用作统计数据中的 listener 标签
+	grpcL := m.MatchNamed("grpc", mini_cmux2.HTTP2HeaderField("content-type", "application/grpc"))
+	// 正向代理需要先于 HTTP1Fast 注册, 否则 CONNECT 请求会被 HTTP 服务匹配
+	if utils.Config().Proxy.Enable {
+		proxyS := &proxyServer.Server{AllowedHosts: utils.Config().Proxy.AllowedHosts}
+		for _, cidr := range utils.Config().Proxy.AllowedClients {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				logging.Fatal(err)
+			}
+			proxyS.AllowedClients = append(proxyS.AllowedClients, n)
+		}
+		go proxyS.Serve(m.MatchNamed("proxy", mini_cmux2.SOCKS5(), mini_cmux2.HTTPConnect()))
+	}
+	wsL := m.MatchNamed("websocket", mini_cmux2.WebSocket())
+	httpL := m.MatchNamed("http", mini_cmux2.HTTP1Fast(), mini_cmux2.HTTP2())
 
 	//grpc
 	grpcS := grpc.NewServer()
@@ -36,11 +102,13 @@ func main() {
 	go grpcS.Serve(grpcL)
 
 	//http
+	ginServer.RegisterMetrics(m)
 	router := ginServer.SetupRouter()
 	httpS := &http.Server{
-		Handler: router,
+		Handler: ginServer.H2CHandler(router),
 	}
 	go httpS.Serve(httpL)
+	go httpS.Serve(wsL)
 
 	//监听关闭信号
 	go syscallOperate.CloseProcess(m, grpcS, httpS)
@@ -1,6 +1,8 @@
 package test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -9,8 +11,10 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,6 +23,10 @@ import (
 	"github.com/ljhhhhhh1224/mini_cmux/grpcServer"
 	hello_grpc "github.com/ljhhhhhh1224/mini_cmux/pb"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
+	"golang.org/x/net/websocket"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 
@@ -255,3 +263,1208 @@ func Serve(errCh chan<- error, muxl mini_cmux2.CMux) {
 		errCh <- err
 	}
 }
+
+func TestServeTwice(t *testing.T) {
+	Convey("TestServeTwice", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		tm := m.MatchTLS(&tls.Config{})
+		errc := make(chan error, 2)
+		go func() { errc <- m.Serve() }()
+		go func() { errc <- m.Serve() }()
+		// 两次 Serve 中只有一个运行, 另一个立即返回
+		var err error
+		select {
+		case err = <-errc:
+		case <-time.After(5 * time.Second):
+		}
+		So(err, ShouldEqual, mini_cmux2.ServingErr)
+
+		// TLS 多路复用器已随 m 启动或在此处启动, 关闭时不会重复清理
+		tmerrc := make(chan error, 1)
+		go func() { tmerrc <- tm.Serve() }()
+		time.Sleep(50 * time.Millisecond)
+		m.Close()
+		l.Close()
+		So(<-errc, ShouldNotBeNil)
+		So(<-tmerrc, ShouldNotBeNil)
+	})
+}
+
+func TestListenerClose(t *testing.T) {
+	Convey("TestListenerClose", t, func() {
+		servererrChan := make(chan error, 2)
+		clienterrChan := make(chan error, 2)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		grpcl := m.MatchNamed("grpc", mini_cmux2.HTTP2HeaderField("content-type", "application/grpc"))
+		httpl := m.Match(mini_cmux2.HTTP1HeaderField("content-type", "application/json"))
+		So(grpcl.Addr().String(), ShouldEqual, "grpc@"+l.Addr().String())
+		So(httpl.Addr().String(), ShouldEqual, l.Addr().String())
+
+		grpcS := grpc.NewServer()
+		hello_grpc.RegisterHelloGRPCServer(grpcS, &grpcServer.Server{})
+		go grpcS.Serve(grpcl)
+		go HTTP1Server(servererrChan, httpl)
+		go Serve(servererrChan, m)
+		defer l.Close()
+
+		So(gRpcClient(clienterrChan, l.Addr().String()), ShouldEqual, GrpcRESP)
+		// GracefulStop 会关闭 grpcl, 不应影响根监听器与 HTTP 服务
+		grpcS.GracefulStop()
+		_, err := grpcl.Accept()
+		So(err, ShouldEqual, mini_cmux2.ListenerCloseErr)
+		So(HTTP1Client(clienterrChan, l.Addr()), ShouldEqual, HTTP1)
+		So(len(clienterrChan), ShouldEqual, 0)
+	})
+}
+
+// HTTP1ClientWithHeader 发送携带指定请求头的 HTTP1 请求
+func HTTP1ClientWithHeader(addr net.Addr, header map[string]string) (string, error) {
+	client := http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	req, err := http.NewRequest("GET", "http://"+addr.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestCombinators(t *testing.T) {
+	Convey("Test And/Or/Not", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		apil := m.Match(mini_cmux2.And(
+			mini_cmux2.Or(
+				mini_cmux2.HTTP1HeaderField("content-type", "application/json"),
+				mini_cmux2.HTTP1HeaderField("X-Api", "v2"),
+			),
+			mini_cmux2.Not(mini_cmux2.HTTP1HeaderField("X-Internal", "1")),
+		))
+		otherl := m.Match(mini_cmux2.HTTP1HeaderField("X-Internal", "1"), mini_cmux2.Any())
+		go textServer(apil, "api")
+		go textServer(otherl, "other")
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		cases := []struct {
+			header map[string]string
+			want   string
+		}{
+			{map[string]string{"content-type": "application/json"}, "api"},
+			{map[string]string{"X-Api": "v2"}, "api"},
+			{map[string]string{"X-Api": "v2", "X-Internal": "1"}, "other"},
+			{map[string]string{"X-Api": "v1"}, "other"},
+		}
+		for _, c := range cases {
+			resp, err := HTTP1ClientWithHeader(l.Addr(), c.header)
+			So(err, ShouldBeNil)
+			So(resp, ShouldEqual, c.want)
+		}
+	})
+}
+
+func TestSniffTimeout(t *testing.T) {
+	Convey("TestSniffTimeout", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithSniffTimeout(100*time.Millisecond))
+		httpl := m.Match(mini_cmux2.HTTP1HeaderField("content-type", "application/json"))
+		go HTTP1Server(make(chan error, 1), httpl)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// 不发送数据与只发送部分数据的连接都会在超时后被关闭
+		for _, prefix := range []string{"", "GET / HT"} {
+			c, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			_, _ = io.WriteString(c, prefix)
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = c.Read(make([]byte, 1))
+			So(err, ShouldEqual, io.EOF)
+			c.Close()
+		}
+		So(m.Stats().SniffTimeouts, ShouldEqual, 2)
+
+		// 匹配成功后清除读超时
+		c, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer c.Close()
+		_, _ = io.WriteString(c, "GET / HTTP/1.1\r\nHost: mini_cmux\r\nContent-Type: application/json\r\n\r\n")
+		time.Sleep(200 * time.Millisecond)
+		_, _ = io.WriteString(c, "GET / HTTP/1.1\r\nHost: mini_cmux\r\n\r\n")
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(c)
+		for i := 0; i < 2; i++ {
+			resp, err := http.ReadResponse(br, nil)
+			So(err, ShouldBeNil)
+			b, _ := ioutil.ReadAll(resp.Body)
+			So(string(b), ShouldEqual, HTTP1)
+		}
+	})
+}
+
+func TestSniffLimit(t *testing.T) {
+	Convey("TestSniffLimit", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithMaxSniffBytes(1024))
+		httpl := m.Match(mini_cmux2.HTTP1HeaderField("content-type", "application/json"))
+		go HTTP1Server(make(chan error, 1), httpl)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		resp, err := HTTP1ClientWithHeader(l.Addr(), map[string]string{"content-type": "application/json"})
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, HTTP1)
+
+		// 超过上限的请求头被视为未匹配
+		_, err = HTTP1ClientWithHeader(l.Addr(), map[string]string{
+			"content-type": "application/json",
+			"X-Padding":    strings.Repeat("a", 2048),
+		})
+		So(err, ShouldNotBeNil)
+		So(m.Stats().SniffOverflows, ShouldEqual, 1)
+	})
+
+	Convey("TestMatcherSniffLimit", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithMatcherSniffBytes(16))
+		httpl := m.Match(mini_cmux2.HTTP1HeaderField("content-type", "application/json"))
+		anyl := m.Match(mini_cmux2.Any())
+		go textServer(httpl, "http1")
+		go textServer(anyl, "any")
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// 请求头超出单个匹配器的读取上限, 由后续匹配器匹配
+		resp, err := HTTP1ClientWithHeader(l.Addr(), map[string]string{"content-type": "application/json"})
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, "any")
+	})
+}
+
+func TestNotFound(t *testing.T) {
+	Convey("TestNotFoundHandler", t, func() {
+		prefixc := make(chan string, 1)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithNotFoundHandler(func(c net.Conn, prefix []byte, err error) bool {
+			prefixc <- string(prefix)
+			if err != mini_cmux2.NotMatchErr {
+				return false
+			}
+			_, _ = io.WriteString(c, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			_ = c.Close()
+			return true
+		}))
+		httpl := m.Match(mini_cmux2.HTTP1HeaderField("content-type", "application/json"))
+		go HTTP1Server(make(chan error, 1), httpl)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		client := http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get("http://" + l.Addr().String() + "/unmatched")
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		So(<-prefixc, ShouldStartWith, "GET /unmatched HTTP/1.1")
+		So(m.Stats().Unmatched, ShouldEqual, 1)
+	})
+
+	Convey("TestDefaultListener", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		httpl := m.Match(mini_cmux2.HTTP1HeaderField("content-type", "application/json"))
+		defaultl := m.Default()
+		So(defaultl, ShouldEqual, m.Default())
+		go textServer(httpl, "json")
+		go textServer(defaultl, "default")
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		resp, err := HTTP1ClientWithHeader(l.Addr(), map[string]string{"content-type": "application/json"})
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, "json")
+		// 未匹配的连接重放嗅探数据后交给兜底监听器
+		resp, err = HTTP1ClientWithHeader(l.Addr(), map[string]string{"content-type": "text/plain"})
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, "default")
+	})
+}
+
+func TestRegister(t *testing.T) {
+	Convey("TestRegister", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		defaultl := m.Default()
+		go textServer(defaultl, "default")
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		header := map[string]string{"X-Plugin": "echo"}
+		resp, err := HTTP1ClientWithHeader(l.Addr(), header)
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, "default")
+
+		// 运行中注册匹配器
+		h := m.Register(mini_cmux2.ListenerConfig{Name: "echo"}, mini_cmux2.HTTP1HeaderField("X-Plugin", "echo"))
+		So(h.Listener().Addr().String(), ShouldEqual, "echo@"+l.Addr().String())
+		go textServer(h.Listener(), "echo")
+		resp, err = HTTP1ClientWithHeader(l.Addr(), header)
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, "echo")
+
+		// 并发注册与注销的同时处理请求
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				m.Register(mini_cmux2.ListenerConfig{}, mini_cmux2.HTTP1HeaderField("X-Plugin", "none")).Unregister()
+			}()
+			go func() {
+				defer wg.Done()
+				_, _ = HTTP1ClientWithHeader(l.Addr(), header)
+			}()
+		}
+		wg.Wait()
+
+		// 注销后连接交给后续的匹配器
+		h.Unregister()
+		_, err = h.Listener().Accept()
+		So(err, ShouldEqual, mini_cmux2.ListenerCloseErr)
+		resp, err = HTTP1ClientWithHeader(l.Addr(), header)
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, "default")
+	})
+}
+
+func TestHTTP1Fast(t *testing.T) {
+	Convey("TestHTTP1Fast", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithSniffTimeout(time.Second))
+		httpl := m.Match(mini_cmux2.HTTP1Fast("PURGE"))
+		defaultl := m.Default()
+		go textServer(httpl, HTTP1)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// 不携带 content-type 的请求也能被匹配
+		resp, err := HTTP1ClientWithHeader(l.Addr(), nil)
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, HTTP1)
+
+		cases := []struct {
+			data    string
+			matched bool
+		}{
+			{"PURGE /cache HTTP/1.1\r\nHost: a\r\n\r\n", true},
+			{"POST /api HTTP/1.0\r\n\r\n", true},
+			{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", false},
+			{"GET / HTTP/2.0\r\n\r\n", false},
+			{"GETX / HTTP/1.1\r\n\r\n", false},
+			{"SSH-2.0-OpenSSH_8.9\r\n", false},
+		}
+		for _, c := range cases {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			_, _ = io.WriteString(conn, c.data)
+			if c.matched {
+				_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			} else {
+				dc, err := defaultl.Accept()
+				So(err, ShouldBeNil)
+				b := make([]byte, len(c.data))
+				_, err = io.ReadFull(dc, b)
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, c.data)
+				dc.Close()
+			}
+			conn.Close()
+		}
+	})
+}
+
+func TestHTTP1Route(t *testing.T) {
+	Convey("TestHTTP1Route", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		adminl := m.Match(mini_cmux2.HTTP1PathPrefix("/admin/"))
+		deletel := m.Match(mini_cmux2.HTTP1Method(http.MethodDelete))
+		exactl := m.Match(mini_cmux2.HTTP1Path("/healthz"))
+		regexpl := m.Match(mini_cmux2.HTTP1PathRegexp(regexp.MustCompile(`^/v[0-9]+/`)))
+		hostl := m.Match(mini_cmux2.HTTP1Host("*.example.com"))
+		otherl := m.Match(mini_cmux2.HTTP1Fast())
+		go textServer(adminl, "admin")
+		go textServer(deletel, "delete")
+		go textServer(exactl, "exact")
+		go textServer(regexpl, "regexp")
+		go textServer(hostl, "host")
+		go textServer(otherl, "other")
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		client := http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{DisableKeepAlives: true},
+		}
+		cases := []struct {
+			method string
+			path   string
+			host   string
+			want   string
+		}{
+			{http.MethodGet, "/admin/users", "", "admin"},
+			{http.MethodGet, "/administrator", "", "other"},
+			{http.MethodDelete, "/users/1", "", "delete"},
+			{http.MethodGet, "/healthz", "", "exact"},
+			{http.MethodGet, "/healthz/", "", "other"},
+			{http.MethodGet, "/v2/items", "", "regexp"},
+			{http.MethodGet, "/", "api.example.com:8080", "host"},
+			{http.MethodGet, "/", "example.com", "other"},
+		}
+		for _, c := range cases {
+			req, _ := http.NewRequest(c.method, "http://"+l.Addr().String()+c.path, nil)
+			if c.host != "" {
+				req.Host = c.host
+			}
+			resp, err := client.Do(req)
+			So(err, ShouldBeNil)
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(string(b), ShouldEqual, c.want)
+		}
+	})
+}
+
+// lockedServer 为只处理 RequestStop 的 gRPC 服务, 不会真正关闭进程
+type lockedServer struct {
+	grpcServer.Server
+}
+
+func (s *lockedServer) RequestStop(ctx context.Context, req *hello_grpc.Req) (*hello_grpc.Res, error) {
+	return &hello_grpc.Res{Message: "locked"}, nil
+}
+
+func TestHTTP2Route(t *testing.T) {
+	Convey("TestHTTP2Route", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		lockedl := m.Match(mini_cmux2.HTTP2Path("/grpc.HelloGRPC/RequestStop"))
+		grpcl := m.Match(mini_cmux2.And(
+			mini_cmux2.HTTP2PathPrefix("/grpc.HelloGRPC/"),
+			mini_cmux2.HTTP2Authority("127.0.0.1"),
+			mini_cmux2.HTTP2HeaderFieldRegexp("content-type", regexp.MustCompile(`^application/grpc(\+proto)?$`)),
+			mini_cmux2.HTTP2HeaderFieldPrefix("user-agent", "grpc-go/"),
+		))
+
+		lockedS := grpc.NewServer()
+		hello_grpc.RegisterHelloGRPCServer(lockedS, &lockedServer{})
+		go lockedS.Serve(lockedl)
+		defer lockedS.Stop()
+		go gRpcServer(make(chan error, 1), grpcl)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		So(gRpcClient(make(chan error, 1), l.Addr().String()), ShouldEqual, GrpcRESP)
+
+		conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		resp, err := hello_grpc.NewHelloGRPCClient(conn).RequestStop(context.Background(), &hello_grpc.Req{Message: "Request stop from grpc client"})
+		So(err, ShouldBeNil)
+		So(resp.GetMessage(), ShouldEqual, "locked")
+	})
+}
+
+// HTTP2Server 以 h2c prior knowledge 方式提供固定返回 body 的 HTTP2 服务
+func HTTP2Server(l net.Listener, body string) {
+	s := &http2.Server{}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.ServeConn(c, &http2.ServeConnOpts{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, body)
+			}),
+		})
+	}
+}
+
+// HTTP2Client 以 h2c prior knowledge 方式发送 HTTP2 请求
+func HTTP2Client(addr net.Addr, path string) (string, error) {
+	client := http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+	resp, err := client.Get("http://" + addr.String() + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestReadOnlyMatchers(t *testing.T) {
+	Convey("TestReadOnly", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		// 匹配失败的 gRPC 匹配器不写入 SETTINGS, HTTP2 服务不会收到多余的 SETTINGS ACK
+		grpcl := m.Match(mini_cmux2.ReadOnly(mini_cmux2.HTTP2HeaderField("content-type", "application/grpc")))
+		h2l := m.Match(mini_cmux2.ReadOnly(mini_cmux2.HTTP2PathPrefix("/h2")))
+		go gRpcServer(make(chan error, 1), grpcl)
+		go HTTP2Server(h2l, "h2")
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		for i := 0; i < 3; i++ {
+			resp, err := HTTP2Client(l.Addr(), "/h2")
+			So(err, ShouldBeNil)
+			So(resp, ShouldEqual, "h2")
+		}
+	})
+
+	Convey("TestWithReadOnlyMatchers", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithReadOnlyMatchers())
+		grpcl := m.Match(mini_cmux2.HTTP2HeaderField("content-type", "application/grpc"))
+		h2l := m.Match(mini_cmux2.HTTP2PathPrefix("/h2"))
+		go gRpcServer(make(chan error, 1), grpcl)
+		go HTTP2Server(h2l, "h2")
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		resp, err := HTTP2Client(l.Addr(), "/h2")
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, "h2")
+	})
+
+	Convey("TestHTTP2SettingsOnce", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		m.Match(
+			mini_cmux2.HTTP2Path("/a"),
+			mini_cmux2.Or(mini_cmux2.HTTP2Path("/b"), mini_cmux2.HTTP2HeaderField("content-type", "application/grpc")),
+		)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer c.Close()
+		_, _ = io.WriteString(c, http2.ClientPreface)
+		fr := http2.NewFramer(c, c)
+		So(fr.WriteSettings(), ShouldBeNil)
+		var hbuf bytes.Buffer
+		enc := hpack.NewEncoder(&hbuf)
+		for _, hf := range []hpack.HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/c"},
+			{Name: ":authority", Value: "mini_cmux"},
+		} {
+			_ = enc.WriteField(hf)
+		}
+		So(fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: hbuf.Bytes(),
+			EndStream:     true,
+			EndHeaders:    true,
+		}), ShouldBeNil)
+
+		// 三个匹配器均未匹配, 连接被关闭前只收到一个 SETTINGS 帧
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		settings := 0
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				break
+			}
+			if sf, ok := f.(*http2.SettingsFrame); ok && !sf.IsAck() {
+				settings++
+			}
+		}
+		So(settings, ShouldEqual, 1)
+	})
+
+	Convey("TestHTTP2SettingsAck", t, func() {
+		// settingsAcks 发送 preface、SETTINGS、请求头与一个 SETTINGS ACK,
+		// 返回服务端 Accept 到的连接中的 SETTINGS ACK 个数
+		settingsAcks := func(opts ...mini_cmux2.Option) int {
+			l, _ := net.Listen("tcp", "127.0.0.1:0")
+			m := mini_cmux2.New(l, opts...)
+			h2l := m.Match(mini_cmux2.HTTP2PathPrefix("/h2"))
+			go Serve(make(chan error, 1), m)
+			defer l.Close()
+
+			c, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			defer c.Close()
+			_, _ = io.WriteString(c, http2.ClientPreface)
+			fr := http2.NewFramer(c, c)
+			So(fr.WriteSettings(), ShouldBeNil)
+			var hbuf bytes.Buffer
+			enc := hpack.NewEncoder(&hbuf)
+			for _, hf := range []hpack.HeaderField{
+				{Name: ":method", Value: "GET"},
+				{Name: ":scheme", Value: "http"},
+				{Name: ":path", Value: "/h2"},
+				{Name: ":authority", Value: "mini_cmux"},
+			} {
+				_ = enc.WriteField(hf)
+			}
+			So(fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: hbuf.Bytes(),
+				EndStream:     true,
+				EndHeaders:    true,
+			}), ShouldBeNil)
+			So(fr.WriteSettingsAck(), ShouldBeNil)
+
+			sc, err := h2l.Accept()
+			So(err, ShouldBeNil)
+			defer sc.Close()
+			_ = sc.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			preface := make([]byte, len(http2.ClientPreface))
+			_, err = io.ReadFull(sc, preface)
+			So(err, ShouldBeNil)
+			acks := 0
+			sfr := http2.NewFramer(ioutil.Discard, sc)
+			for {
+				f, err := sfr.ReadFrame()
+				if err != nil {
+					break
+				}
+				if sf, ok := f.(*http2.SettingsFrame); ok && sf.IsAck() {
+					acks++
+				}
+			}
+			return acks
+		}
+
+		// 匹配器发送了 SETTINGS, 客户端对它的 ACK 被去掉
+		So(settingsAcks(), ShouldEqual, 0)
+		// 写入被丢弃时客户端的 ACK 是对服务端 SETTINGS 的确认, 需要保留
+		So(settingsAcks(mini_cmux2.WithReadOnlyMatchers()), ShouldEqual, 1)
+	})
+}
+
+func TestMatchReaders(t *testing.T) {
+	Convey("TestMatchReaders", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		var leaked io.Reader
+		// 先注册的可写入匹配器也会在只读匹配器之后运行
+		grpcl := m.MatchWriters(mini_cmux2.HTTP2HeaderField("content-type", "application/grpc"))
+		prefacel := m.MatchReaders(func(r io.Reader) bool {
+			leaked = r
+			b := make([]byte, len(http2.ClientPreface))
+			_, err := io.ReadFull(r, b)
+			return err == nil && string(b) == http2.ClientPreface
+		})
+		go gRpcServer(make(chan error, 1), grpcl)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer c.Close()
+		_, _ = io.WriteString(c, http2.ClientPreface)
+		So(http2.NewFramer(c, c).WriteSettings(), ShouldBeNil)
+
+		sc, err := prefacel.Accept()
+		So(err, ShouldBeNil)
+		defer sc.Close()
+		// 只读匹配器返回后无法继续读取连接
+		n, err := leaked.Read(make([]byte, 1))
+		So(n, ShouldEqual, 0)
+		So(err, ShouldEqual, io.EOF)
+		// 客户端没有收到任何匹配器写入的数据
+		_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = c.Read(make([]byte, 1))
+		So(isTimeout(err), ShouldBeTrue)
+		// 嗅探到的数据被完整重放
+		b := make([]byte, len(http2.ClientPreface))
+		_, err = io.ReadFull(sc, b)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, http2.ClientPreface)
+	})
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestH2C(t *testing.T) {
+	Convey("TestH2C", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		grpcl := m.Match(mini_cmux2.HTTP2HeaderField("content-type", "application/grpc"))
+		upgradel := m.Match(mini_cmux2.H2CUpgrade())
+		httpl := m.Match(mini_cmux2.HTTP1Fast(), mini_cmux2.HTTP2())
+		go gRpcServer(make(chan error, 1), grpcl)
+		handler := h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.Proto)
+		}), &http2.Server{})
+		go func() { _ = (&http.Server{Handler: handler}).Serve(upgradel) }()
+		go func() { _ = (&http.Server{Handler: handler}).Serve(httpl) }()
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		So(gRpcClient(make(chan error, 1), l.Addr().String()), ShouldEqual, GrpcRESP)
+
+		// gRPC 匹配器发送的 SETTINGS 帧的 ACK 不会交给 HTTP2 服务, 连接不会因协议错误被关闭
+		var dials int32
+		client := http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					atomic.AddInt32(&dials, 1)
+					return net.Dial(network, addr)
+				},
+			},
+		}
+		for i := 0; i < 3; i++ {
+			resp, err := client.Get("http://" + l.Addr().String())
+			So(err, ShouldBeNil)
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			So(string(b), ShouldEqual, "HTTP/2.0")
+			time.Sleep(50 * time.Millisecond)
+		}
+		So(atomic.LoadInt32(&dials), ShouldEqual, 1)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer c.Close()
+		_, _ = io.WriteString(c, "GET / HTTP/1.1\r\nHost: mini_cmux\r\n"+
+			"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAoAAAAAIAAAAA\r\n\r\n")
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusSwitchingProtocols)
+
+		So(HTTP1Client(make(chan error, 1), l.Addr()), ShouldEqual, "HTTP/1.1")
+	})
+}
+
+func TestWebSocket(t *testing.T) {
+	Convey("TestWebSocket", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		wsl := m.Match(mini_cmux2.WebSocket())
+		httpl := m.Match(mini_cmux2.HTTP1Fast())
+		go func() {
+			_ = (&http.Server{Handler: websocket.Handler(func(ws *websocket.Conn) {
+				_, _ = io.Copy(ws, ws)
+			})}).Serve(wsl)
+		}()
+		go textServer(httpl, HTTP1)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		ws, err := websocket.Dial("ws://"+l.Addr().String()+"/", "", "http://"+l.Addr().String())
+		So(err, ShouldBeNil)
+		defer ws.Close()
+		So(websocket.Message.Send(ws, "echo"), ShouldBeNil)
+		var msg string
+		So(websocket.Message.Receive(ws, &msg), ShouldBeNil)
+		So(msg, ShouldEqual, "echo")
+
+		// 缺少 Sec-WebSocket-Key 的升级请求不是 WebSocket 握手
+		resp, err := HTTP1ClientWithHeader(l.Addr(), map[string]string{
+			"Connection": "Upgrade",
+			"Upgrade":    "websocket",
+		})
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, HTTP1)
+	})
+}
+
+func TestServerFirst(t *testing.T) {
+	Convey("TestServerFirst", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		m := mini_cmux2.New(l, mini_cmux2.WithSniffTimeout(5*time.Second), mini_cmux2.WithProxyProtocol(loopback))
+		sfl := m.MatchServerFirst(100 * time.Millisecond)
+		httpl := m.Match(mini_cmux2.HTTP1Fast())
+		// 模拟 SMTP 服务, 连接建立后先发送问候并附带客户端地址
+		go func() {
+			for {
+				c, err := sfl.Accept()
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(c, "220 %s\r\n", c.RemoteAddr())
+				c.Close()
+			}
+		}()
+		go textServer(httpl, HTTP1)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		greeting := func(header string) string {
+			c, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			defer c.Close()
+			_, _ = io.WriteString(c, header)
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b, _ := ioutil.ReadAll(c)
+			return string(b)
+		}
+
+		So(greeting(""), ShouldStartWith, "220 127.0.0.1:")
+		// 代理只发送了 PROXY 头, 客户端等待服务端的问候
+		So(greeting("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n"), ShouldEqual, "220 192.0.2.1:56324\r\n")
+		// 发送了数据的客户端继续正常匹配
+		So(HTTP1Client(make(chan error, 1), l.Addr()), ShouldEqual, HTTP1)
+	})
+
+	Convey("TestServerFirstSniffTimeout", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithSniffTimeout(500*time.Millisecond))
+		m.MatchServerFirst(400 * time.Millisecond)
+		m.Match(mini_cmux2.HTTP1Fast())
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// 客户端在等待时间内发送了部分数据, 嗅探阶段的读超时仍从接收连接时开始计算
+		start := time.Now()
+		c, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer c.Close()
+		time.Sleep(300 * time.Millisecond)
+		_, _ = io.WriteString(c, "G")
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = ioutil.ReadAll(c)
+		So(err, ShouldBeNil)
+		So(time.Since(start), ShouldBeLessThan, 700*time.Millisecond)
+		So(m.Stats().SniffTimeouts, ShouldEqual, 1)
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("TestMetrics", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		grpcl := m.MatchNamed("grpc", mini_cmux2.HTTP2HeaderField("content-type", "application/grpc"))
+		idlel := m.Match(mini_cmux2.HTTP1Path("/idle"))
+		httpl := m.Match(mini_cmux2.HTTP1Fast())
+		go gRpcServer(make(chan error, 1), grpcl)
+		go textServer(httpl, HTTP1)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		So(gRpcClient(make(chan error, 1), l.Addr().String()), ShouldEqual, GrpcRESP)
+		So(HTTP1Client(make(chan error, 1), l.Addr()), ShouldEqual, HTTP1)
+
+		// 未匹配的连接会被关闭
+		c, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		_, _ = io.WriteString(c, "garbage\r\n\r\n")
+		_, err = ioutil.ReadAll(c)
+		So(err, ShouldBeNil)
+		c.Close()
+
+		// 没有服务 Accept 的连接留在队列中, 关闭监听器时被丢弃
+		idle, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer idle.Close()
+		_, _ = io.WriteString(idle, "GET /idle HTTP/1.1\r\nHost: mini_cmux\r\n\r\n")
+		for i := 0; i < 100 && m.Stats().Listeners[1].QueueLen == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(m.Stats().Listeners[1].QueueLen, ShouldEqual, 1)
+		So(idlel.Close(), ShouldBeNil)
+
+		s := m.Stats()
+		So(len(s.Listeners), ShouldEqual, 3)
+		So(s.Listeners[0], ShouldResemble, mini_cmux2.ListenerStats{Name: "grpc", Matched: 1, Dispatched: 1})
+		So(s.Listeners[1], ShouldResemble, mini_cmux2.ListenerStats{Name: "2", Matched: 1, Dispatched: 1, Dropped: 1})
+		So(s.Listeners[2].Name, ShouldEqual, "3")
+		So(s.Listeners[2].Matched, ShouldEqual, 1)
+		So(s.Unmatched, ShouldEqual, 1)
+		So(s.SniffErrors, ShouldEqual, 0)
+		So(s.SniffLatency.Count, ShouldEqual, 4)
+
+		var buf bytes.Buffer
+		So(s.WritePrometheus(&buf), ShouldBeNil)
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_connections_matched_total{listener=\"grpc\"} 1\n")
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_connections_dropped_total{listener=\"2\"} 1\n")
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_connections_unmatched_total 1\n")
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_sniff_duration_seconds_bucket{le=\"+Inf\"} 4\n")
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_sniff_duration_seconds_count 4\n")
+	})
+}
+
+func TestOverflow(t *testing.T) {
+	Convey("TestOverflow", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		fallbackl := m.Match(mini_cmux2.HTTP1Path("/fallback"))
+		m.Register(mini_cmux2.ListenerConfig{Name: "reject", QueueSize: 1, Overflow: mini_cmux2.OverflowReject},
+			mini_cmux2.HTTP1Path("/reject"))
+		m.Register(mini_cmux2.ListenerConfig{Name: "block", QueueSize: 1, BlockTimeout: 100 * time.Millisecond},
+			mini_cmux2.HTTP1Path("/block"))
+		m.Register(mini_cmux2.ListenerConfig{Name: "spill", QueueSize: 1, Overflow: mini_cmux2.OverflowSpill, Fallback: fallbackl},
+			mini_cmux2.HTTP1Path("/spill"))
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// 没有服务 Accept, 第一个连接留在队列中
+		get := func(path string) net.Conn {
+			c, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			_, _ = io.WriteString(c, "GET "+path+" HTTP/1.1\r\nHost: mini_cmux\r\n\r\n")
+			return c
+		}
+		// 队列已满的连接被关闭时客户端读到 EOF
+		closed := func(c net.Conn) bool {
+			defer c.Close()
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err := c.Read(make([]byte, 1))
+			return err == io.EOF
+		}
+		waitQueued := func(i int) {
+			for j := 0; j < 100 && m.Stats().Listeners[i].QueueLen == 0; j++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(m.Stats().Listeners[i].QueueLen, ShouldEqual, 1)
+		}
+
+		defer get("/reject").Close()
+		waitQueued(1)
+		So(closed(get("/reject")), ShouldBeTrue)
+
+		defer get("/block").Close()
+		waitQueued(2)
+		start := time.Now()
+		So(closed(get("/block")), ShouldBeTrue)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 100*time.Millisecond)
+
+		defer get("/spill").Close()
+		waitQueued(3)
+		go textServer(fallbackl, "fallback")
+		c := get("/spill")
+		defer c.Close()
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		So(err, ShouldBeNil)
+		b, _ := ioutil.ReadAll(resp.Body)
+		So(string(b), ShouldEqual, "fallback")
+
+		s := m.Stats()
+		So(s.Listeners[0].Dispatched, ShouldEqual, 1)
+		So(s.Listeners[1], ShouldResemble, mini_cmux2.ListenerStats{Name: "reject", Matched: 2, Dispatched: 1, QueueLen: 1, Rejected: 1})
+		So(s.Listeners[2], ShouldResemble, mini_cmux2.ListenerStats{Name: "block", Matched: 2, Dispatched: 1, QueueLen: 1, TimedOut: 1})
+		So(s.Listeners[3], ShouldResemble, mini_cmux2.ListenerStats{Name: "spill", Matched: 2, Dispatched: 1, QueueLen: 1, Spilled: 1})
+
+		var buf bytes.Buffer
+		So(s.WritePrometheus(&buf), ShouldBeNil)
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_connections_overflow_total{listener=\"reject\",outcome=\"rejected\"} 1\n")
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_connections_overflow_total{listener=\"block\",outcome=\"timeout\"} 1\n")
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_connections_overflow_total{listener=\"spill\",outcome=\"spilled\"} 1\n")
+	})
+
+	Convey("TestOverflowSpillMaxConns", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		fallbackl := m.Register(mini_cmux2.ListenerConfig{Name: "fallback", MaxConns: 1}, mini_cmux2.HTTP1Path("/fallback")).Listener()
+		m.Register(mini_cmux2.ListenerConfig{Name: "spill", QueueSize: 1, MaxConns: 10, Overflow: mini_cmux2.OverflowSpill, Fallback: fallbackl},
+			mini_cmux2.HTTP1Path("/spill"))
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		dial := func() net.Conn {
+			c, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			_, _ = io.WriteString(c, "GET /spill HTTP/1.1\r\nHost: mini_cmux\r\n\r\n")
+			return c
+		}
+		waitFor := func(cond func() bool) {
+			for i := 0; i < 100 && !cond(); i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(cond(), ShouldBeTrue)
+		}
+		// 第一个连接留在 spill 的队列中, 第二个连接转交给 fallback, 名额随之转移
+		defer dial().Close()
+		waitFor(func() bool { return m.Stats().Listeners[1].QueueLen == 1 })
+		defer dial().Close()
+		waitFor(func() bool { return m.Stats().Listeners[0].QueueLen == 1 })
+		s := m.Stats()
+		So(s.Listeners[0].Active, ShouldEqual, 1)
+		So(s.Listeners[1].Active, ShouldEqual, 1)
+
+		// fallback 的连接数已达上限, 第三个连接被关闭
+		c := dial()
+		defer c.Close()
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := c.Read(make([]byte, 1))
+		So(err, ShouldEqual, io.EOF)
+		s = m.Stats()
+		So(s.Listeners[1].Spilled, ShouldEqual, 1)
+		So(s.Listeners[1].Rejected, ShouldEqual, 1)
+		So(s.Listeners[1].Active, ShouldEqual, 1)
+
+		// 转交的连接关闭后释放的是 fallback 的名额
+		fc, err := fallbackl.Accept()
+		So(err, ShouldBeNil)
+		So(fc.Close(), ShouldBeNil)
+		s = m.Stats()
+		So(s.Listeners[0].Active, ShouldEqual, 0)
+		So(s.Listeners[1].Active, ShouldEqual, 1)
+	})
+
+	Convey("TestOverflowForeignFallback", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		defer l.Close()
+		other := mini_cmux2.New(l).Match(mini_cmux2.Any())
+		m := mini_cmux2.New(l)
+		So(func() {
+			m.Register(mini_cmux2.ListenerConfig{Overflow: mini_cmux2.OverflowSpill, Fallback: other}, mini_cmux2.Any())
+		}, ShouldPanic)
+		So(func() {
+			m.Register(mini_cmux2.ListenerConfig{Overflow: mini_cmux2.OverflowSpill, Fallback: l}, mini_cmux2.Any())
+		}, ShouldPanic)
+		So(func() {
+			m.Register(mini_cmux2.ListenerConfig{Overflow: mini_cmux2.OverflowSpill}, mini_cmux2.Any())
+		}, ShouldPanic)
+	})
+}
+
+func TestAdmission(t *testing.T) {
+	dial := func(addr net.Addr, data string) net.Conn {
+		c, err := net.Dial("tcp", addr.String())
+		So(err, ShouldBeNil)
+		_, _ = io.WriteString(c, data)
+		return c
+	}
+	// 被拒绝的连接被关闭时客户端读到 EOF
+	closed := func(c net.Conn) bool {
+		defer c.Close()
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := c.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+	waitFor := func(cond func() bool) {
+		for i := 0; i < 100 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(cond(), ShouldBeTrue)
+	}
+
+	Convey("TestMaxSniffing", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithMaxSniffing(1))
+		go textServer(m.Match(mini_cmux2.HTTP1Fast()), HTTP1)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// 不发送数据的连接一直处于匹配阶段
+		idle := dial(l.Addr(), "")
+		waitFor(func() bool { return m.Stats().Sniffing == 1 })
+		So(closed(dial(l.Addr(), "")), ShouldBeTrue)
+		So(m.Stats().SniffLimited, ShouldEqual, 1)
+
+		idle.Close()
+		waitFor(func() bool { return m.Stats().Sniffing == 0 })
+		So(HTTP1Client(make(chan error, 1), l.Addr()), ShouldEqual, HTTP1)
+	})
+
+	Convey("TestMaxSniffingStalledListener", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithMaxSniffing(1))
+		m.Register(mini_cmux2.ListenerConfig{Name: "stalled", QueueSize: 1}, mini_cmux2.HTTP1Path("/stalled"))
+		go textServer(m.Match(mini_cmux2.HTTP1Fast()), HTTP1)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// 没有服务 Accept 的监听器队列已满, 等待队列的连接不计入正在匹配的连接数
+		req := "GET /stalled HTTP/1.1\r\nHost: mini_cmux\r\n\r\n"
+		queued := dial(l.Addr(), req)
+		defer queued.Close()
+		waitFor(func() bool { return m.Stats().Listeners[0].QueueLen == 1 })
+		blocked := dial(l.Addr(), req)
+		defer blocked.Close()
+		waitFor(func() bool { return m.Stats().Listeners[0].Matched == 2 })
+		So(m.Stats().Sniffing, ShouldEqual, 0)
+		So(HTTP1Client(make(chan error, 1), l.Addr()), ShouldEqual, HTTP1)
+		So(m.Stats().SniffLimited, ShouldEqual, 0)
+	})
+
+	Convey("TestMaxConnsPerIP", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithMaxConnsPerIP(2))
+		go textServer(m.Match(mini_cmux2.HTTP1Fast()), HTTP1)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		idle1, idle2 := dial(l.Addr(), ""), dial(l.Addr(), "")
+		defer idle2.Close()
+		waitFor(func() bool { return m.Stats().Sniffing == 2 })
+		So(closed(dial(l.Addr(), "")), ShouldBeTrue)
+		So(m.Stats().IPLimited, ShouldEqual, 1)
+
+		// 连接关闭后释放名额
+		idle1.Close()
+		waitFor(func() bool { return m.Stats().Sniffing == 1 })
+		So(HTTP1Client(make(chan error, 1), l.Addr()), ShouldEqual, HTTP1)
+	})
+
+	Convey("TestMaxConnsPerIPProxyProtocol", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		m := mini_cmux2.New(l, mini_cmux2.WithMaxConnsPerIP(1), mini_cmux2.WithProxyProtocol(loopback))
+		go textServer(m.Match(mini_cmux2.HTTP1Fast()), HTTP1)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// 经过同一代理的连接按 PROXY 头中的客户端地址分别计算
+		a := dial(l.Addr(), "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+		defer a.Close()
+		b := dial(l.Addr(), "PROXY TCP4 192.0.2.2 198.51.100.1 56324 443\r\n")
+		defer b.Close()
+		waitFor(func() bool { return m.Stats().Sniffing == 2 })
+		// 等待两个连接读取完 PROXY 头
+		time.Sleep(100 * time.Millisecond)
+		So(closed(dial(l.Addr(), "PROXY TCP4 192.0.2.1 198.51.100.1 56325 443\r\n")), ShouldBeTrue)
+		So(m.Stats().IPLimited, ShouldEqual, 1)
+	})
+
+	Convey("TestListenerMaxConns", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		limitedl := m.Register(mini_cmux2.ListenerConfig{Name: "limited", MaxConns: 1}, mini_cmux2.HTTP1Path("/limited")).Listener()
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		req := "GET /limited HTTP/1.1\r\nHost: mini_cmux\r\n\r\n"
+		first := dial(l.Addr(), req)
+		defer first.Close()
+		waitFor(func() bool { return m.Stats().Listeners[0].Active == 1 })
+		So(closed(dial(l.Addr(), req)), ShouldBeTrue)
+
+		// 已被 Accept 的连接在关闭前仍占用名额
+		c, err := limitedl.Accept()
+		So(err, ShouldBeNil)
+		So(closed(dial(l.Addr(), req)), ShouldBeTrue)
+		So(c.Close(), ShouldBeNil)
+		So(m.Stats().Listeners[0].Active, ShouldEqual, 0)
+
+		third := dial(l.Addr(), req)
+		defer third.Close()
+		c, err = limitedl.Accept()
+		So(err, ShouldBeNil)
+		defer c.Close()
+
+		s := m.Stats()
+		So(s.Listeners[0], ShouldResemble, mini_cmux2.ListenerStats{Name: "limited", Matched: 4, Dispatched: 2, Active: 1, Limited: 2})
+
+		var buf bytes.Buffer
+		So(s.WritePrometheus(&buf), ShouldBeNil)
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_connections_limited_total{listener=\"limited\"} 2\n")
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_listener_connections{listener=\"limited\"} 1\n")
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_connections_rejected_total{reason=\"per_ip\"} 0\n")
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	// 被关闭的连接读到 EOF
+	closed := func(addr net.Addr) bool {
+		c, err := net.Dial("tcp", addr.String())
+		So(err, ShouldBeNil)
+		defer c.Close()
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = c.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	Convey("TestRateLimitClose", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithRateLimit(mini_cmux2.RateLimit{Rate: 1, Burst: 2}))
+		go textServer(m.Match(mini_cmux2.HTTP1Fast()), HTTP1)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		So(HTTP1Client(make(chan error, 1), l.Addr()), ShouldEqual, HTTP1)
+		So(HTTP1Client(make(chan error, 1), l.Addr()), ShouldEqual, HTTP1)
+		So(closed(l.Addr()), ShouldBeTrue)
+		s := m.Stats()
+		So(s.RateLimited, ShouldEqual, 1)
+		// 被限速的连接不会进入匹配阶段
+		So(s.SniffLatency.Count, ShouldEqual, 2)
+
+		var buf bytes.Buffer
+		So(s.WritePrometheus(&buf), ShouldBeNil)
+		So(buf.String(), ShouldContainSubstring, "mini_cmux_connections_rejected_total{reason=\"rate\"} 1\n")
+	})
+
+	Convey("TestRateLimitDelay", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithRateLimit(mini_cmux2.RateLimit{
+			Rate:     5,
+			Burst:    1,
+			Delay:    true,
+			MaxDelay: 300 * time.Millisecond,
+		}))
+		go textServer(m.Match(mini_cmux2.HTTP1Fast()), HTTP1)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		start := time.Now()
+		So(HTTP1Client(make(chan error, 1), l.Addr()), ShouldEqual, HTTP1)
+		// 令牌每 200ms 补充一个, 第二个连接被延迟
+		So(HTTP1Client(make(chan error, 1), l.Addr()), ShouldEqual, HTTP1)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 150*time.Millisecond)
+		// 延迟中的连接继续预支令牌, 之后需要等待超过 MaxDelay 的连接被关闭
+		delayed, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer delayed.Close()
+		So(closed(l.Addr()), ShouldBeTrue)
+
+		s := m.Stats()
+		So(s.RateDelayed, ShouldEqual, 2)
+		So(s.RateLimited, ShouldEqual, 1)
+	})
+	Convey("TestRateLimitDefaultMaxDelay", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithRateLimit(mini_cmux2.RateLimit{Rate: 1, Burst: 1, Delay: true}))
+		go textServer(m.Match(mini_cmux2.HTTP1Fast()), HTTP1)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		So(HTTP1Client(make(chan error, 1), l.Addr()), ShouldEqual, HTTP1)
+		// 未设置 MaxDelay 时最长延迟 1s, 单个来源延迟中的连接数有上限
+		delayed, err := net.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer delayed.Close()
+		So(closed(l.Addr()), ShouldBeTrue)
+
+		s := m.Stats()
+		So(s.RateDelayed, ShouldEqual, 1)
+		So(s.RateLimited, ShouldEqual, 1)
+	})
+}
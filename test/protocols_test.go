@@ -0,0 +1,142 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	mini_cmux2 "github.com/ljhhhhhh1224/mini_cmux/mini_cmux"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// 各客户端建立连接后发送的第一段数据
+var captures = []struct {
+	name     string
+	protocol string // 应匹配的协议, 为空表示不应被任何协议匹配器匹配
+	data     []byte
+}{
+	// OpenSSH 8.9 (ssh -v)
+	{"openssh", "ssh", []byte("SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.1\r\n")},
+	// PuTTY 0.76
+	{"putty", "ssh", []byte("SSH-2.0-PuTTY_Release_0.76\r\n")},
+	// 兼容 SSH1 的旧客户端
+	{"ssh-1.99", "ssh", []byte("SSH-1.99-OpenSSH_3.9p1\r\n")},
+	// psql 14, sslmode=prefer 时先发送 SSLRequest
+	{"psql-sslrequest", "postgresql", []byte("\x00\x00\x00\x08\x04\xd2\x16\x2f")},
+	// psql 14, sslmode=disable
+	{"psql-startup", "postgresql", []byte("\x00\x00\x00\x54\x00\x03\x00\x00" +
+		"user\x00postgres\x00database\x00postgres\x00application_name\x00psql\x00client_encoding\x00UTF8\x00\x00")},
+	// libpq 16, gssencmode=prefer
+	{"psql-gssenc", "postgresql", []byte("\x00\x00\x00\x08\x04\xd2\x16\x30")},
+	// pg_cancel_backend 发起的 CancelRequest
+	{"psql-cancel", "postgresql", []byte("\x00\x00\x00\x10\x04\xd2\x16\x2e\x00\x00\x30\x39\x1a\x2b\x3c\x4d")},
+	// redis-cli PING
+	{"redis-cli-ping", "redis", []byte("*1\r\n$4\r\nPING\r\n")},
+	// go-redis 建立连接后的 HELLO 3
+	{"go-redis-hello", "redis", []byte("*2\r\n$5\r\nhello\r\n$1\r\n3\r\n")},
+	// redis-cli SET
+	{"redis-cli-set", "redis", []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n")},
+	// mosquitto_sub -V mqttv311, 空 client id
+	{"mosquitto-311", "mqtt", []byte("\x10\x0c\x00\x04MQTT\x04\x02\x00\x3c\x00\x00")},
+	// mosquitto_sub -V mqttv31
+	{"mosquitto-31", "mqtt", []byte("\x10\x1b\x00\x06MQIsdp\x03\x02\x00\x3c\x00\x0dmosq-a1b2c3d4")},
+	// paho.mqtt.golang, MQTT 5.0
+	{"paho-5", "mqtt", []byte("\x10\x10\x00\x04MQTT\x05\x02\x00\x1e\x00\x00\x03abc")},
+	// rabbitmq/amqp091-go
+	{"amqp091", "amqp", []byte("AMQP\x00\x00\x09\x01")},
+	// qpid-proton, AMQP 1.0 SASL
+	{"amqp10-sasl", "amqp", []byte("AMQP\x03\x01\x00\x00")},
+
+	// curl --socks5, 支持无认证与用户名密码认证
+	{"curl-socks5", "socks5", []byte("\x05\x02\x00\x02")},
+	// curl --proxytunnel
+	{"curl-connect", "connect", []byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nUser-Agent: curl/7.81.0\r\n\r\n")},
+
+	{"http1", "", []byte("GET / HTTP/1.1\r\nHost: mini_cmux\r\n\r\n")},
+	{"http2-preface", "", []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")},
+	{"tls-record", "", []byte("\x16\x03\x01\x00\xa5\x01\x00\x00\xa1\x03\x03")},
+	{"redis-inline", "", []byte("PING\r\n")},
+	{"redis-bad-cmd", "", []byte("*1\r\n$4\r\nP1N6\r\n")},
+	{"ssh-truncated", "", []byte("SSH-2.")},
+	{"pg-no-user", "", []byte("\x00\x00\x00\x1b\x00\x03\x00\x00database\x00postgres\x00\x00")},
+	{"pg-bad-length", "", []byte("\x00\x00\x00\x09\x04\xd2\x16\x2f\x00")},
+	{"mqtt-publish", "", []byte("\x30\x0c\x00\x04MQTT\x04\x02\x00\x3c\x00\x00")},
+	{"mqtt-bad-level", "", []byte("\x10\x0c\x00\x04MQTT\x09\x02\x00\x3c\x00\x00")},
+	{"amqp-unknown", "", []byte("AMQP\x09\x09\x09\x09")},
+	{"socks4", "", []byte("\x04\x01\x01\xbb\x7f\x00\x00\x01\x00")},
+	{"socks5-no-methods", "", []byte("\x05\x00")},
+}
+
+var protocolMatchers = []struct {
+	protocol string
+	matcher  mini_cmux2.MatchWriter
+}{
+	{"ssh", mini_cmux2.SSH()},
+	{"postgresql", mini_cmux2.PostgreSQL()},
+	{"redis", mini_cmux2.Redis()},
+	{"mqtt", mini_cmux2.MQTT()},
+	{"amqp", mini_cmux2.AMQP()},
+	{"socks5", mini_cmux2.SOCKS5()},
+	{"connect", mini_cmux2.HTTPConnect()},
+}
+
+// oneByteReader 每次只返回一个字节, 模拟分多次到达的数据
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+func TestProtocolMatchers(t *testing.T) {
+	Convey("TestProtocolMatchers", t, func() {
+		for _, c := range captures {
+			for _, pm := range protocolMatchers {
+				want := c.protocol == pm.protocol
+				So(pm.matcher(ioutil.Discard, bytes.NewReader(c.data)), ShouldEqual, want)
+				So(pm.matcher(ioutil.Discard, oneByteReader{bytes.NewReader(c.data)}), ShouldEqual, want)
+			}
+		}
+	})
+}
+
+func TestProtocolRouting(t *testing.T) {
+	Convey("TestProtocolRouting", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithSniffTimeout(time.Second))
+		listeners := make(map[string]net.Listener)
+		for _, pm := range protocolMatchers {
+			listeners[pm.protocol] = m.Match(pm.matcher)
+		}
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		for _, c := range captures {
+			if c.protocol == "" {
+				continue
+			}
+			conn, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			_, err = conn.Write(c.data)
+			So(err, ShouldBeNil)
+
+			// 匹配后服务端读取到完整的原始数据
+			sc, err := listeners[c.protocol].Accept()
+			So(err, ShouldBeNil)
+			got := make([]byte, len(c.data))
+			_, err = io.ReadFull(sc, got)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, c.data)
+			sc.Close()
+			conn.Close()
+		}
+	})
+}
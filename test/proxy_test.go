@@ -0,0 +1,225 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	mini_cmux2 "github.com/ljhhhhhh1224/mini_cmux/mini_cmux"
+
+	hello_grpc "github.com/ljhhhhhh1224/mini_cmux/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// remoteAddrServer 启动一个返回 r.RemoteAddr 的 HTTP 服务
+func remoteAddrServer(l net.Listener) {
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.RemoteAddr)
+		}),
+	}
+	_ = s.Serve(l)
+}
+
+// proxyHTTPGet 先发送 header 再发送一个 HTTP1 请求, 返回响应内容
+func proxyHTTPGet(addr net.Addr, header []byte) (string, error) {
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	req := append(append([]byte(nil), header...), "GET / HTTP/1.1\r\nHost: mini_cmux\r\nConnection: close\r\n\r\n"...)
+	if _, err := c.Write(req); err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+// proxyV2Header 构造携带 TCP 地址的 PROXY protocol v2 头
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+	b := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	b = append(b, 0x21) // v2, PROXY
+	var addrs []byte
+	if ip4 := src.IP.To4(); ip4 != nil {
+		b = append(b, 0x11)
+		addrs = append(append(addrs, ip4...), dst.IP.To4()...)
+	} else {
+		b = append(b, 0x21)
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	addrs = append(addrs, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	// 附带一个会被忽略的 TLV
+	addrs = append(addrs, 0x04, 0x00, 0x01, 0x00)
+	var n [2]byte
+	binary.BigEndian.PutUint16(n[:], uint16(len(addrs)))
+	return append(append(b, n[:]...), addrs...)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	Convey("TestProxyProtocol", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		m := mini_cmux2.New(l, mini_cmux2.WithProxyProtocol(loopback))
+		grpcl := m.Match(mini_cmux2.HTTP2HeaderField("content-type", "application/grpc"))
+		httpl := m.Match(mini_cmux2.HTTP1Fast())
+		go gRpcServer(make(chan error, 1), grpcl)
+		go remoteAddrServer(httpl)
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+		cases := []struct {
+			header []byte
+			want   string
+		}{
+			{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324"},
+			{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n"), "[2001:db8::1]:1234"},
+			{proxyV2Header(&net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 8080}, dst), "192.0.2.7:8080"},
+			{proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 9090},
+				&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}), "[2001:db8::7]:9090"},
+		}
+		for _, c := range cases {
+			resp, err := proxyHTTPGet(l.Addr(), c.header)
+			So(err, ShouldBeNil)
+			So(resp, ShouldEqual, c.want)
+		}
+
+		// UNKNOWN 与没有 PROXY 头的连接使用连接本身的地址
+		for _, header := range [][]byte{[]byte("PROXY UNKNOWN\r\n"), nil} {
+			resp, err := proxyHTTPGet(l.Addr(), header)
+			So(err, ShouldBeNil)
+			host, _, _ := net.SplitHostPort(resp)
+			So(host, ShouldEqual, "127.0.0.1")
+		}
+
+		// gRPC 连接同样去掉 PROXY 头
+		conn, err := grpc.Dial(l.Addr().String(),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+				c, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+				if err != nil {
+					return nil, err
+				}
+				_, err = c.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+				return c, err
+			}))
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		resp, err := hello_grpc.NewHelloGRPCClient(conn).SayHi(context.Background(), &hello_grpc.Req{Message: "Say hi from proxied grpc client"})
+		So(err, ShouldBeNil)
+		So(resp.GetMessage(), ShouldEqual, GrpcRESP)
+	})
+
+	Convey("TestProxyProtocolInvalid", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		errc := make(chan error, 1)
+		m := mini_cmux2.New(l, mini_cmux2.WithProxyProtocol(loopback), mini_cmux2.WithNotFoundHandler(func(c net.Conn, prefix []byte, err error) bool {
+			errc <- err
+			return false
+		}))
+		go remoteAddrServer(m.Match(mini_cmux2.HTTP1Fast()))
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		_, err := proxyHTTPGet(l.Addr(), []byte("PROXY TCP4 not-an-ip 198.51.100.1 56324 443\r\n"))
+		So(err, ShouldNotBeNil)
+		So(<-errc, ShouldEqual, mini_cmux2.ProxyHeaderErr)
+	})
+
+	Convey("TestProxyProtocolMatcherSniffBytes", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		m := mini_cmux2.New(l, mini_cmux2.WithProxyProtocol(loopback), mini_cmux2.WithMatcherSniffBytes(32))
+		go remoteAddrServer(m.Match(mini_cmux2.HTTP1Fast()))
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// PROXY 头不受单个匹配器的读取上限限制
+		resp, err := proxyHTTPGet(l.Addr(), []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, "192.0.2.1:56324")
+		So(m.Stats().SniffOverflows, ShouldEqual, 0)
+	})
+
+	Convey("TestProxyProtocolDefault", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		m := mini_cmux2.New(l, mini_cmux2.WithProxyProtocol(loopback), mini_cmux2.WithMaxSniffBytes(16))
+		go remoteAddrServer(m.Default())
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// PROXY 头超出嗅探上限时连接被关闭, 不会带着 PROXY 头交给兜底监听器
+		_, err := proxyHTTPGet(l.Addr(), []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+		So(err, ShouldNotBeNil)
+		s := m.Stats()
+		So(s.SniffOverflows, ShouldEqual, 1)
+		So(s.Listeners[0].Dispatched, ShouldEqual, 0)
+	})
+
+	Convey("TestProxyProtocolRateLimit", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		m := mini_cmux2.New(l, mini_cmux2.WithProxyProtocol(loopback),
+			mini_cmux2.WithRateLimit(mini_cmux2.RateLimit{Rate: 1, Burst: 1}))
+		go remoteAddrServer(m.Match(mini_cmux2.HTTP1Fast()))
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// 经过同一代理的客户端按 PROXY 头中的地址分别限速
+		resp, err := proxyHTTPGet(l.Addr(), []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, "192.0.2.1:56324")
+		resp, err = proxyHTTPGet(l.Addr(), []byte("PROXY TCP4 192.0.2.2 198.51.100.1 56324 443\r\n"))
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, "192.0.2.2:56324")
+		_, err = proxyHTTPGet(l.Addr(), []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56325 443\r\n"))
+		So(err, ShouldNotBeNil)
+		So(m.Stats().RateLimited, ShouldEqual, 1)
+	})
+
+	Convey("TestProxyProtocolUntrusted", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		_, private, _ := net.ParseCIDR("10.0.0.0/8")
+		m := mini_cmux2.New(l, mini_cmux2.WithProxyProtocol(private))
+		go remoteAddrServer(m.Match(mini_cmux2.HTTP1Fast()))
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// 不可信来源的 PROXY 头不会被解析, 连接无法匹配
+		_, err := proxyHTTPGet(l.Addr(), []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+		So(err, ShouldNotBeNil)
+		So(m.Stats().Unmatched, ShouldEqual, 1)
+	})
+
+	Convey("TestProxyProtocolNoTrusted", t, func() {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l, mini_cmux2.WithProxyProtocol())
+		go remoteAddrServer(m.Match(mini_cmux2.HTTP1Fast()))
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		// 未设置可信网段时不信任任何来源, 客户端无法伪造地址
+		_, err := proxyHTTPGet(l.Addr(), []byte("PROXY TCP4 127.0.0.1 198.51.100.1 56324 443\r\n"))
+		So(err, ShouldNotBeNil)
+		So(m.Stats().Unmatched, ShouldEqual, 1)
+	})
+}
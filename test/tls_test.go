@@ -0,0 +1,250 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	mini_cmux2 "github.com/ljhhhhhh1224/mini_cmux/mini_cmux"
+
+	"github.com/ljhhhhhh1224/mini_cmux/grpcServer"
+	hello_grpc "github.com/ljhhhhhh1224/mini_cmux/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// selfSignedConfig 为测试生成包含 hosts 的自签名证书配置
+func selfSignedConfig(t *testing.T, hosts ...string) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mini_cmux"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     hosts,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func HTTPSClient(errChan chan<- error, addr net.Addr, serverName string) string {
+	client := http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: serverName},
+		},
+	}
+	resp, err := client.Get("https://" + addr.String())
+	if err != nil {
+		errChan <- err
+		return ""
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		errChan <- err
+	}
+	return string(b)
+}
+
+func TestTLS(t *testing.T) {
+	Convey("Test TLS", t, func() {
+		servererrChan := make(chan error, 1)
+		clienterrChan := make(chan error, 1)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		tlsl := m.Match(mini_cmux2.TLS())
+		httpl := m.Match(mini_cmux2.HTTP1HeaderField("content-type", "application/json"))
+		go HTTP1Server(servererrChan, tls.NewListener(tlsl, selfSignedConfig(t)))
+		go HTTP1Server(servererrChan, httpl)
+		go Serve(servererrChan, m)
+		defer l.Close()
+
+		So(HTTPSClient(clienterrChan, l.Addr(), ""), ShouldEqual, HTTP1)
+		So(HTTP1Client(clienterrChan, l.Addr()), ShouldEqual, HTTP1)
+		So(len(clienterrChan), ShouldEqual, 0)
+	})
+}
+
+func TestTLSVersion(t *testing.T) {
+	Convey("Test TLS version", t, func() {
+		servererrChan := make(chan error, 1)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		tls12l := m.Match(mini_cmux2.TLS(tls.VersionTLS12))
+		tlsl := m.Match(mini_cmux2.TLS())
+		go HTTP1Server(servererrChan, tls.NewListener(tls12l, selfSignedConfig(t)))
+		go Serve(servererrChan, m)
+		defer l.Close()
+
+		// TLS1.3 客户端不会被 TLS1.2 匹配器匹配
+		accepted := make(chan struct{}, 1)
+		go func() {
+			if c, err := tlsl.Accept(); err == nil {
+				accepted <- struct{}{}
+				c.Close()
+			}
+		}()
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		if c, err := tls.DialWithDialer(dialer, "tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13}); err == nil {
+			c.Close()
+		}
+		So(len(accepted), ShouldEqual, 1)
+	})
+}
+
+// textServer 启动一个固定返回 body 的 HTTP 服务
+func textServer(l net.Listener, body string) {
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}),
+	}
+	_ = s.Serve(l)
+}
+
+func TestTLSServerName(t *testing.T) {
+	Convey("Test TLS server name", t, func() {
+		clienterrChan := make(chan error, 16)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		exactl := m.Match(mini_cmux2.TLSServerName("api.example.com"))
+		wildcardl := m.Match(mini_cmux2.TLSServerName("*.example.org"))
+		suffixl := m.Match(mini_cmux2.TLSServerNameSuffix("example.net", "internal"))
+		defaultl := m.Match(mini_cmux2.TLS())
+		cfg := selfSignedConfig(t)
+		go textServer(tls.NewListener(exactl, cfg), "exact")
+		go textServer(tls.NewListener(wildcardl, cfg), "wildcard")
+		go textServer(tls.NewListener(suffixl, cfg), "suffix")
+		go textServer(tls.NewListener(defaultl, cfg), "default")
+		go Serve(make(chan error, 1), m)
+		defer l.Close()
+
+		cases := []struct {
+			serverName string
+			want       string
+		}{
+			{"api.example.com", "exact"},
+			{"API.Example.com", "exact"},
+			{"www.example.org", "wildcard"},
+			{"a.b.example.org", "default"},
+			{"example.org", "default"},
+			{"example.net", "suffix"},
+			{"a.b.example.net", "suffix"},
+			{"db.internal", "suffix"},
+			{"badexample.net", "default"},
+		}
+		for _, c := range cases {
+			So(HTTPSClient(clienterrChan, l.Addr(), c.serverName), ShouldEqual, c.want)
+		}
+		So(len(clienterrChan), ShouldEqual, 0)
+	})
+}
+
+func TestTLSALPN(t *testing.T) {
+	Convey("Test TLS ALPN", t, func() {
+		servererrChan := make(chan error, 2)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		h2l := m.Match(mini_cmux2.TLSALPN("h2", "grpc-exp"))
+		http1l := m.Match(mini_cmux2.TLSALPN("http/1.1"))
+		cfg := selfSignedConfig(t)
+
+		grpcS := grpc.NewServer(grpc.Creds(credentials.NewTLS(cfg)))
+		hello_grpc.RegisterHelloGRPCServer(grpcS, &grpcServer.Server{})
+		go grpcS.Serve(h2l)
+		defer grpcS.Stop()
+		go textServer(tls.NewListener(http1l, cfg), HTTP1)
+		go Serve(servererrChan, m)
+		defer l.Close()
+
+		conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(
+			credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		resp, err := hello_grpc.NewHelloGRPCClient(conn).SayHi(context.Background(), &hello_grpc.Req{Message: "Say hi from tls grpc client"})
+		So(err, ShouldBeNil)
+		So(resp.GetMessage(), ShouldEqual, GrpcRESP)
+
+		client := http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}},
+			},
+		}
+		httpResp, err := client.Get("https://" + l.Addr().String())
+		So(err, ShouldBeNil)
+		defer httpResp.Body.Close()
+		b, _ := ioutil.ReadAll(httpResp.Body)
+		So(string(b), ShouldEqual, HTTP1)
+	})
+}
+
+func TestMatchTLS(t *testing.T) {
+	Convey("Test TLS termination", t, func() {
+		servererrChan := make(chan error, 4)
+		clienterrChan := make(chan error, 4)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		m := mini_cmux2.New(l)
+		cfg := selfSignedConfig(t)
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+		tm := m.MatchTLS(cfg)
+		grpcl := tm.Match(mini_cmux2.HTTP2HeaderField("content-type", "application/grpc"))
+		httpsl := tm.Match(mini_cmux2.HTTP1HeaderField("content-type", "application/json"))
+		httpl := m.Match(mini_cmux2.HTTP1HeaderField("content-type", "application/json"))
+
+		go gRpcServer(servererrChan, grpcl)
+		go HTTP1Server(servererrChan, httpsl)
+		go textServer(httpl, "plaintext")
+		go Serve(servererrChan, m)
+		defer l.Close()
+
+		conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(
+			credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		resp, err := hello_grpc.NewHelloGRPCClient(conn).SayHi(context.Background(), &hello_grpc.Req{Message: "Say hi from tls grpc client"})
+		So(err, ShouldBeNil)
+		So(resp.GetMessage(), ShouldEqual, GrpcRESP)
+
+		client := http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+		req, _ := http.NewRequest("GET", "https://"+l.Addr().String(), nil)
+		req.Header.Add("content-type", "application/json")
+		httpResp, err := client.Do(req)
+		So(err, ShouldBeNil)
+		defer httpResp.Body.Close()
+		b, _ := ioutil.ReadAll(httpResp.Body)
+		So(string(b), ShouldEqual, HTTP1)
+
+		So(HTTP1Client(clienterrChan, l.Addr()), ShouldEqual, "plaintext")
+		So(len(clienterrChan), ShouldEqual, 0)
+	})
+}
@@ -20,8 +20,27 @@ type config struct {
 	TimeFormat  string
 
 	Server struct {
-		Port    string
-		Network string
+		Port         string
+		Network      string
+		SniffTimeout string // 嗅探阶段的读超时, 如 "10s", 为空时不设置
+
+		ProxyProtocol  bool     // 是否解析负载均衡器发送的 PROXY protocol 头
+		TrustedProxies []string // 允许发送 PROXY 头的来源网段, 如 "10.0.0.0/8", 开启 ProxyProtocol 时不能为空
+
+		MaxSniffing      int // 同时进行匹配的最大连接数, 为 0 时不限制
+		MaxListenerConns int // 每个监听器的最大连接数, 为 0 时不限制
+		MaxConnsPerIP    int // 每个来源 IP 的最大连接数, 为 0 时不限制
+
+		RateLimit      float64 // 每个来源 IP(IPv6 按 /64 聚合)每秒允许的连接数, 为 0 时不限制
+		RateBurst      int     // 允许的突发连接数, 为 0 时与 RateLimit 相同
+		RateLimitDelay bool    // 超出速率时延迟匹配而不是关闭连接
+		RateMaxDelay   string  // 最长延迟, 如 "1s", 需要等待更久的连接被关闭, 为空时为 1s
+	}
+
+	Proxy struct {
+		Enable         bool     // 是否在服务端口上开启 SOCKS5 与 HTTP CONNECT 正向代理
+		AllowedClients []string // 允许使用代理的客户端网段, 如 "10.0.0.0/8"
+		AllowedHosts   []string // 允许访问的目标主机, 支持 "*.example.com"、CIDR 与 "*"
 	}
 
 	Client struct {
@@ -44,6 +63,10 @@ func GetGrpcClientIP(ctx context.Context) (string, error) {
 	if pr.Addr == net.Addr(nil) {
 		return "", fmt.Errorf("[getClientIP] peer.Addr is nil")
 	}
+	// 使用 SplitHostPort 以支持 PROXY 头中携带的 IPv6 客户端地址
+	if host, _, err := net.SplitHostPort(pr.Addr.String()); err == nil {
+		return host, nil
+	}
 	addSlice := strings.Split(pr.Addr.String(), ":")
 	return addSlice[0], nil
 }